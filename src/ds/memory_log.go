@@ -0,0 +1,59 @@
+package ds
+
+import "sync"
+
+// MemoryLog is a Log kept in memory, it survives the crash of its users but not of the process
+type MemoryLog struct {
+	records [][]byte
+	offsets map[string]int
+	mu      sync.Mutex
+}
+
+func NewMemoryLog() *MemoryLog {
+	return &MemoryLog{
+		records: [][]byte{},
+		offsets: map[string]int{},
+	}
+}
+
+func (ml *MemoryLog) Append(data []byte) (int, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.records = append(ml.records, append([]byte{}, data...))
+	return len(ml.records) - 1, nil
+}
+
+func (ml *MemoryLog) Read(offset int) ([]byte, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if offset < 0 || offset >= len(ml.records) {
+		return nil, ErrOffsetOutOfRange
+	}
+	return append([]byte{}, ml.records[offset]...), nil
+}
+
+func (ml *MemoryLog) End() int {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return len(ml.records)
+}
+
+func (ml *MemoryLog) Commit(consumer string, offset int) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if offset < 0 || offset > len(ml.records) {
+		return ErrOffsetOutOfRange
+	}
+	ml.offsets[consumer] = offset
+	return nil
+}
+
+func (ml *MemoryLog) Offset(consumer string) int {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return ml.offsets[consumer]
+}
+
+func (ml *MemoryLog) Close() error {
+	return nil
+}
@@ -0,0 +1,32 @@
+package ds_test
+
+import (
+	"atm/ds"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryLog(t *testing.T) {
+	ml := ds.NewMemoryLog()
+	assert.Equal(t, 0, ml.End())
+
+	for i := 0; i < 3; i++ {
+		offset, err := ml.Append([]byte(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, i, offset)
+	}
+	assert.Equal(t, 3, ml.End())
+
+	data, err := ml.Read(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(data))
+	_, err = ml.Read(3)
+	assert.Equal(t, ds.ErrOffsetOutOfRange, err)
+
+	assert.Nil(t, ml.Commit("tx_manager", 3))
+	assert.Equal(t, ds.ErrOffsetOutOfRange, ml.Commit("tx_manager", 4))
+	assert.Equal(t, 3, ml.Offset("tx_manager"))
+	assert.Equal(t, 0, ml.Offset("order"))
+}
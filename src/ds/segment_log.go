@@ -0,0 +1,322 @@
+package ds
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultSegmentSize = 1024
+
+	segmentExt  = ".seg"
+	offsetsFile = "offsets.json"
+	headerSize  = 8
+)
+
+var (
+	ErrOffsetOutOfRange = errors.New("offset out of range")
+	ErrCorruptRecord    = errors.New("corrupt record")
+)
+
+// Log is an append-only sequence of records.
+// Each consumer commits the offset of the next record it reads.
+type Log interface {
+	Append(data []byte) (int, error)
+	Read(offset int) ([]byte, error)
+	// End returns the offset of the next appended record
+	End() int
+	Commit(consumer string, offset int) error
+	Offset(consumer string) int
+	Close() error
+}
+
+type segment struct {
+	base      int
+	file      *os.File
+	positions []int64
+	size      int64
+}
+
+// SegmentLog is a file-backed Log split into segments of at most segmentSize records.
+// Every append and commit is fsynced, so the log can be reopened after a crash.
+type SegmentLog struct {
+	dir         string
+	segmentSize int
+	segments    []*segment
+	offsets     map[string]int
+	mu          sync.Mutex
+}
+
+// OpenSegmentLog opens the log in the directory, or creates a new one.
+// A torn record at the end of the last segment is truncated.
+func OpenSegmentLog(dir string, segmentSize int) (*SegmentLog, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	sl := &SegmentLog{
+		dir:         dir,
+		segmentSize: segmentSize,
+		segments:    []*segment{},
+		offsets:     map[string]int{},
+	}
+	if err := sl.load(); err != nil {
+		sl.Close()
+		return nil, err
+	}
+	return sl, nil
+}
+
+func (sl *SegmentLog) load() error {
+	entries, err := os.ReadDir(sl.dir)
+	if err != nil {
+		return err
+	}
+	bases := []int{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		base, err := strconv.Atoi(strings.TrimSuffix(name, segmentExt))
+		if err != nil {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	sort.Ints(bases)
+	for i, base := range bases {
+		seg, err := sl.openSegment(base, i == len(bases)-1)
+		if err != nil {
+			return err
+		}
+		sl.segments = append(sl.segments, seg)
+	}
+
+	data, err := os.ReadFile(filepath.Join(sl.dir, offsetsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &sl.offsets)
+}
+
+func (sl *SegmentLog) segmentPath(base int) string {
+	return filepath.Join(sl.dir, fmt.Sprintf("%020d%s", base, segmentExt))
+}
+
+// openSegment scans the records of the segment.
+// Only the last segment may end with a torn record, which is truncated.
+func (sl *SegmentLog) openSegment(base int, last bool) (*segment, error) {
+	file, err := os.OpenFile(sl.segmentPath(base), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	seg := &segment{
+		base:      base,
+		file:      file,
+		positions: []int64{},
+	}
+	for seg.size < info.Size() {
+		_, n, err := readRecord(file, seg.size)
+		if errors.Is(err, ErrCorruptRecord) && last {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("segment %d at %d: %w", base, seg.size, err)
+		}
+		seg.positions = append(seg.positions, seg.size)
+		seg.size += n
+	}
+	if seg.size == info.Size() {
+		return seg, nil
+	}
+	if err := file.Truncate(seg.size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return seg, nil
+}
+
+// readRecord reads the record at pos and returns its payload and its length on the disk
+func readRecord(file *os.File, pos int64) ([]byte, int64, error) {
+	header := make([]byte, headerSize)
+	if _, err := file.ReadAt(header, pos); err != nil {
+		if err == io.EOF {
+			return nil, 0, ErrCorruptRecord
+		}
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, pos+headerSize); err != nil {
+		if err == io.EOF {
+			return nil, 0, ErrCorruptRecord
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != checksum {
+		return nil, 0, ErrCorruptRecord
+	}
+	return data, headerSize + int64(length), nil
+}
+
+func (sl *SegmentLog) active() (*segment, error) {
+	if len(sl.segments) > 0 {
+		last := sl.segments[len(sl.segments)-1]
+		if len(last.positions) < sl.segmentSize {
+			return last, nil
+		}
+	}
+	seg, err := sl.openSegment(sl.end(), true)
+	if err != nil {
+		return nil, err
+	}
+	sl.segments = append(sl.segments, seg)
+	return seg, nil
+}
+
+func (sl *SegmentLog) Append(data []byte) (int, error) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	seg, err := sl.active()
+	if err != nil {
+		return 0, err
+	}
+	record := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[headerSize:], data)
+	if _, err := seg.file.WriteAt(record, seg.size); err != nil {
+		return 0, err
+	}
+	if err := seg.file.Sync(); err != nil {
+		return 0, err
+	}
+	offset := seg.base + len(seg.positions)
+	seg.positions = append(seg.positions, seg.size)
+	seg.size += int64(len(record))
+	return offset, nil
+}
+
+func (sl *SegmentLog) Read(offset int) ([]byte, error) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	// the first segment whose records are beyond the offset
+	i := sort.Search(len(sl.segments), func(i int) bool {
+		seg := sl.segments[i]
+		return seg.base+len(seg.positions) > offset
+	})
+	if offset < 0 || i == len(sl.segments) || offset < sl.segments[i].base {
+		return nil, ErrOffsetOutOfRange
+	}
+	seg := sl.segments[i]
+	data, _, err := readRecord(seg.file, seg.positions[offset-seg.base])
+	return data, err
+}
+
+func (sl *SegmentLog) End() int {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return sl.end()
+}
+
+func (sl *SegmentLog) end() int {
+	if len(sl.segments) == 0 {
+		return 0
+	}
+	last := sl.segments[len(sl.segments)-1]
+	return last.base + len(last.positions)
+}
+
+// Segments returns the number of segment files
+func (sl *SegmentLog) Segments() int {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return len(sl.segments)
+}
+
+// Commit persists the offset of the consumer by replacing the offsets file atomically
+func (sl *SegmentLog) Commit(consumer string, offset int) error {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if offset < 0 || offset > sl.end() {
+		return ErrOffsetOutOfRange
+	}
+	prev, ok := sl.offsets[consumer]
+	sl.offsets[consumer] = offset
+	if err := sl.writeOffsets(); err != nil {
+		if ok {
+			sl.offsets[consumer] = prev
+		} else {
+			delete(sl.offsets, consumer)
+		}
+		return err
+	}
+	return nil
+}
+
+func (sl *SegmentLog) writeOffsets() error {
+	data, err := json.Marshal(sl.offsets)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(sl.dir, offsetsFile)
+	tmp, err := os.CreateTemp(sl.dir, offsetsFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (sl *SegmentLog) Offset(consumer string) int {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return sl.offsets[consumer]
+}
+
+func (sl *SegmentLog) Close() error {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	var err error
+	for _, seg := range sl.segments {
+		if cerr := seg.file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	sl.segments = []*segment{}
+	return err
+}
@@ -0,0 +1,95 @@
+package ds_test
+
+import (
+	"atm/ds"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegmentLog(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := ds.OpenSegmentLog(dir, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, sl.End())
+
+	for i := 0; i < 5; i++ {
+		offset, err := sl.Append([]byte(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, i, offset)
+	}
+	assert.Equal(t, 5, sl.End())
+	assert.Equal(t, 3, sl.Segments())
+
+	data, err := sl.Read(3)
+	assert.Nil(t, err)
+	assert.Equal(t, "3", string(data))
+	_, err = sl.Read(5)
+	assert.Equal(t, ds.ErrOffsetOutOfRange, err)
+
+	assert.Nil(t, sl.Commit("order", 2))
+	assert.Equal(t, ds.ErrOffsetOutOfRange, sl.Commit("order", 6))
+	assert.Nil(t, sl.Close())
+
+	// the records and the offsets survive the restart
+	sl, err = ds.OpenSegmentLog(dir, 2)
+	assert.Nil(t, err)
+	defer sl.Close()
+	assert.Equal(t, 5, sl.End())
+	assert.Equal(t, 2, sl.Offset("order"))
+	assert.Equal(t, 0, sl.Offset("payment"))
+	for i := 0; i < 5; i++ {
+		data, err := sl.Read(i)
+		assert.Nil(t, err)
+		assert.Equal(t, strconv.Itoa(i), string(data))
+	}
+}
+
+func TestSegmentLogTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := ds.OpenSegmentLog(dir, 0)
+	assert.Nil(t, err)
+	sl.Append([]byte("apple"))
+	sl.Append([]byte("orange"))
+	assert.Nil(t, sl.Close())
+
+	// the crash interrupts the write of the last record
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	assert.Equal(t, 1, len(matches))
+	info, _ := os.Stat(matches[0])
+	assert.Nil(t, os.Truncate(matches[0], info.Size()-2))
+
+	sl, err = ds.OpenSegmentLog(dir, 0)
+	assert.Nil(t, err)
+	defer sl.Close()
+	assert.Equal(t, 1, sl.End())
+	offset, err := sl.Append([]byte("kiwi"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, offset)
+	data, _ := sl.Read(1)
+	assert.Equal(t, "kiwi", string(data))
+}
+
+func TestSegmentLogCorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := ds.OpenSegmentLog(dir, 2)
+	assert.Nil(t, err)
+	for _, fruit := range []string{"apple", "orange", "kiwi"} {
+		sl.Append([]byte(fruit))
+	}
+	assert.Nil(t, sl.Close())
+
+	// a torn record is only expected at the tail of the last segment
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	assert.Equal(t, 2, len(matches))
+	info, _ := os.Stat(matches[0])
+	assert.Nil(t, os.Truncate(matches[0], info.Size()-2))
+
+	_, err = ds.OpenSegmentLog(dir, 2)
+	assert.ErrorIs(t, err, ds.ErrCorruptRecord)
+	info, _ = os.Stat(matches[0])
+	assert.NotZero(t, info.Size())
+}
@@ -1,28 +1,102 @@
 package main
 
 import (
+	"atm/simulation"
 	"flag"
 	"fmt"
+	"os"
 )
 
 var pattern string
 var cfg string
+var experiment string
 
 func init() {
 	flag.StringVar(&pattern, "p", "default", "the selected pattern for simulation")
 	flag.StringVar(&cfg, "c", "", "the config filename")
+	flag.StringVar(&experiment, "e", "", "the experiment to run instead of a simulation (duplicate)")
 }
 
-func main() {
-	fmt.Println("Simulation Start!")
+// the pattern of the config is used unless -p is given
+func patternSet() bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "p" {
+			set = true
+		}
+	})
+	return set
+}
 
-	// gateway := broker.MockGateway{}
-	// coordinator := broker.MockCoordinator{}
+// runDuplicate prints the duplicates of each stage with and without deduplication,
+// then their mean over the seeds at fractional rates
+func runDuplicate() int {
+	rows, err := simulation.NewDuplicateExperiment(simulation.DefaultExperimentRounds, 1.0).Run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to run the experiment: %v\n", err)
+		return 1
+	}
+	simulation.PrintDuplicateTable(os.Stdout, rows)
+	fmt.Println()
+	sweep, err := simulation.NewDuplicateSweep(simulation.DefaultExperimentRounds).Run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to run the experiment: %v\n", err)
+		return 1
+	}
+	simulation.PrintDuplicateSweepTable(os.Stdout, sweep)
+	return 0
+}
 
-	// simulation.Simulate(simulation.System{
-	// 	Gateway:     &gateway,
-	// 	Coordinator: coordinator,
-	// }, simulation.InitConf{})
+func run() int {
+	switch experiment {
+	case "":
+	case "duplicate":
+		return runDuplicate()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown experiment: %s\n", experiment)
+		return 1
+	}
+	simConf := simulation.NewSimulationConfig()
+	if cfg != "" {
+		var err error
+		simConf, err = simulation.LoadConfig(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+			return 1
+		}
+	}
+	if simConf.Pattern == nil || patternSet() {
+		p, err := simulation.NamedPattern(pattern)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		simConf.Pattern = p
+	}
 
+	fmt.Println("Simulation Start!")
+	simulator := simulation.NewRoundSimultor()
+	defer simulator.Close()
+	if err := simulator.Simulate(*simConf); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to simulate: %v\n", err)
+		return 1
+	}
 	fmt.Println("Simluation End!")
+
+	for _, status := range simulator.Sys.Gateway.QueryAll() {
+		fmt.Printf("%s: %v (round %d)\n", status.TxID, status.State, status.Round)
+	}
+	fmt.Printf("tx manager availability: %.1f%%\n", simulator.Availability()*100)
+	if errs := simulator.Verify(); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 2
+	}
+	return 0
+}
+
+func main() {
+	flag.Parse()
+	os.Exit(run())
 }
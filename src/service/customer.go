@@ -5,20 +5,43 @@ import "atm/ds"
 type CustomerService struct {
 	sys        *System
 	queue      ds.Queue
+	store      Store
 	dispatcher *EventDispatcher
 }
 
 func NewCustomerService(sys *System) *CustomerService {
+	store := NewMemoryStore()
+	sys.RegisterStore(ServiceCustomer, store)
 	dispatcher := NewEventDispatcher(sys.EventQueue, ServiceCustomer)
+	dispatcher.SetStore(store)
 
 	dispatcher.Focus("customer").
-		Add(func(e Event) (Event, error) {
+		AddTxWithCompensation(func(tx StoreTx, e Event) (Event, error) {
+			// charge the customer under the semantic lock
+			customerID, ok := e.Get("CustomerID")
+			amount, hasAmount := e.GetInt("Amount")
+			if !ok || !hasAmount {
+				return e, nil
+			}
+			key := customerID.(string)
+			balance, _ := tx.Get(key)
+			total, _ := balance.(int)
+			if err := tx.Put(key, total+amount); err != nil {
+				return e, err
+			}
+			return e, nil
+		}, func(tx StoreTx, e Event) (Event, error) {
+			if customerID, ok := e.Get("CustomerID"); ok {
+				tx.Restore(customerID.(string))
+			}
+			e.Set("CustomerStatus", "restored")
 			return e, nil
 		})
 
 	return &CustomerService{
 		sys:        sys,
 		queue:      ds.NewMutexTimedPriorityQueue(&sys.Cfg.round),
+		store:      store,
 		dispatcher: dispatcher,
 	}
 }
@@ -28,12 +51,5 @@ func (cts *CustomerService) Name() string {
 }
 
 func (cts *CustomerService) Receive() {
-	eq := cts.sys.EventQueue
-	for {
-		e, err := eq.Pull(ServiceCustomer)
-		if err != nil {
-			break
-		}
-		cts.dispatcher.Dispatch(e)
-	}
+	cts.sys.EventQueue.Consume(ServiceCustomer, cts.dispatcher.Dispatch)
 }
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// the primitives of a stage in a saga definition
+const (
+	// call the stage 0 of the endpoint of the service
+	OpCall = "call"
+	// report the commit of the control endpoint to the tx manager
+	OpCommit = "commit"
+	// report the abort of the control endpoint to the tx manager
+	OpAbort = "abort"
+	// end the transaction
+	OpEnd = "end"
+	// set the field of the event body
+	OpSet = "set"
+	// fail the stage with the probability, then the transaction is aborted
+	OpFail = "fail"
+)
+
+// SagaDefinition describes the services of a saga topology
+type SagaDefinition struct {
+	Services []ServiceDefinition `json:"services"`
+}
+
+type ServiceDefinition struct {
+	Name      string               `json:"name"`
+	Endpoints []EndpointDefinition `json:"endpoints"`
+}
+
+type EndpointDefinition struct {
+	Name   string            `json:"name"`
+	Stages []StageDefinition `json:"stages"`
+}
+
+// StageDefinition runs its ops in order, a stage without ops returns to the caller after the last stage
+type StageDefinition struct {
+	Ops          []OpDefinition `json:"ops"`
+	Compensation []OpDefinition `json:"compensation"`
+}
+
+type OpDefinition struct {
+	Op          string      `json:"op"`
+	Service     string      `json:"service,omitempty"`
+	Endpoint    string      `json:"endpoint,omitempty"`
+	Key         string      `json:"key,omitempty"`
+	Value       interface{} `json:"value,omitempty"`
+	Probability float64     `json:"probability,omitempty"`
+}
+
+func LoadSagaDefinition(path string) (SagaDefinition, error) {
+	def := SagaDefinition{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return def, err
+	}
+	if err := json.Unmarshal(data, &def); err != nil {
+		return def, err
+	}
+	return def, def.Validate()
+}
+
+func (def SagaDefinition) Validate() error {
+	for _, sd := range def.Services {
+		if sd.Name == "" {
+			return fmt.Errorf("%w: service without name", ErrInvalidDefinition)
+		}
+		for _, ed := range sd.Endpoints {
+			if ed.Name == "" {
+				return fmt.Errorf("%w: endpoint without name in %s", ErrInvalidDefinition, sd.Name)
+			}
+			if len(ed.Stages) == 0 {
+				return fmt.Errorf("%w: endpoint %s/%s has no stage", ErrInvalidDefinition, sd.Name, ed.Name)
+			}
+			for i, stage := range ed.Stages {
+				ops := append(append([]OpDefinition{}, stage.Ops...), stage.Compensation...)
+				for _, op := range ops {
+					if err := op.validate(); err != nil {
+						return fmt.Errorf("%w: %s: %v", ErrInvalidDefinition, StageName(sd.Name, ed.Name, i), err)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (op OpDefinition) validate() error {
+	switch op.Op {
+	case OpCall:
+		if op.Service == "" || op.Endpoint == "" {
+			return fmt.Errorf("call without service or endpoint")
+		}
+	case OpSet:
+		if op.Key == "" {
+			return fmt.Errorf("set without key")
+		}
+	case OpFail:
+		if op.Probability < 0 || op.Probability > 1 {
+			return fmt.Errorf("probability %v out of range", op.Probability)
+		}
+	case OpCommit, OpAbort, OpEnd:
+	default:
+		return fmt.Errorf("unknown op %q", op.Op)
+	}
+	return nil
+}
+
+// Define registers the services of the definition, replacing the services with the same names
+func (sys *System) Define(def SagaDefinition) error {
+	if err := def.Validate(); err != nil {
+		return err
+	}
+	for _, sd := range def.Services {
+		sys.Register(NewSagaService(sys, sd))
+	}
+	return nil
+}
+
+// SagaService is a service built from its definition
+type SagaService struct {
+	sys        *System
+	name       string
+	dispatcher *EventDispatcher
+}
+
+func NewSagaService(sys *System, def ServiceDefinition) *SagaService {
+	store := NewMemoryStore()
+	sys.RegisterStore(def.Name, store)
+	dispatcher := NewEventDispatcher(sys.EventQueue, def.Name)
+	dispatcher.SetStore(store)
+
+	for _, ed := range def.Endpoints {
+		chain := dispatcher.Focus(ed.Name)
+		for _, stage := range ed.Stages {
+			ef := stageFunc(sys, stage.Ops)
+			if len(stage.Compensation) > 0 {
+				chain.AddWithCompensation(ef, stageFunc(sys, stage.Compensation))
+			} else {
+				chain.Add(ef)
+			}
+		}
+	}
+
+	return &SagaService{
+		sys:        sys,
+		name:       def.Name,
+		dispatcher: dispatcher,
+	}
+}
+
+func stageFunc(sys *System, ops []OpDefinition) EventFunc {
+	return func(e Event) (Event, error) {
+		for _, op := range ops {
+			switch op.Op {
+			case OpCall:
+				e.To = op.Service
+				e.Endpoint = op.Endpoint
+				e.Stage = 0
+			case OpCommit:
+				e.Commit()
+			case OpAbort:
+				e.Abort()
+			case OpEnd:
+				e.End()
+			case OpSet:
+				e.Set(op.Key, op.Value)
+			case OpFail:
+				if sys.Chance(op.Probability) {
+					return e, ErrStageFailed
+				}
+			}
+		}
+		return e, nil
+	}
+}
+
+func (ss *SagaService) Name() string {
+	return ss.name
+}
+
+func (ss *SagaService) Receive() {
+	ss.sys.EventQueue.Consume(ss.name, ss.dispatcher.Dispatch)
+}
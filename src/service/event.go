@@ -8,21 +8,27 @@ import (
 )
 
 type Event struct {
-	TxID               string
-	From               string
-	To                 string
-	Round              int
+	TxID  string
+	From  string
+	To    string
+	Round int
+	// the round after which the transaction expires
+	Deadline           int
 	CurrentRetryTime   int
 	RemainingRetryTime int
 	Endpoint           string
 	Stage              int
-	Phase              Phase
-	State              State
-	Action             Action
-	Controller         string
-	CallStack          []string
-	RollbackStack      []string
-	Body               map[string]interface{}
+	Tag                int
+	// the lease of the pulled event, assigned by the event queue
+	Receipt       int
+	Phase         Phase
+	State         State
+	Action        Action
+	Controller    string
+	RollbackMode  RollbackMode
+	CallStack     []string
+	RollbackStack []string
+	Body          map[string]interface{}
 }
 
 func NewEvent() Event {
@@ -48,7 +54,7 @@ func (e *Event) PopCallStack() (string, bool) {
 }
 
 func (e *Event) PushCallStack(srv, endpoint string, stage int) {
-	e.CallStack = append(e.CallStack, fmt.Sprintf("%s|%s|%d", srv, endpoint, stage))
+	e.CallStack = append(e.CallStack, StageName(srv, endpoint, stage))
 }
 
 func (e *Event) ClearCallStack() {
@@ -66,7 +72,7 @@ func (e *Event) PopRollbackStack() (string, bool) {
 }
 
 func (e *Event) PushRollbackStack(srv, endpoint string, stage int) {
-	e.RollbackStack = append(e.RollbackStack, fmt.Sprintf("%s|%s|%d", srv, endpoint, stage))
+	e.RollbackStack = append(e.RollbackStack, StageName(srv, endpoint, stage))
 }
 
 func (e *Event) Commit() {
@@ -94,17 +100,46 @@ func (e *Event) End() {
 	e.Stage = 0
 }
 
+// NewAbort returns an event asking the tx manager to abort the transaction
+func (e *Event) NewAbort(cause error) Event {
+	abort := NewEvent()
+	abort.TxID = e.TxID
+	abort.To = ServiceTxManager
+	abort.Round = e.Round
+	abort.Deadline = e.Deadline
+	abort.RemainingRetryTime = DefaultRetryTime
+	abort.Phase = PhaseProcessing
+	abort.State = StateAbort
+	abort.RollbackMode = e.RollbackMode
+	abort.RollbackStack = append(abort.RollbackStack, e.RollbackStack...)
+	abort.Set("Error", cause.Error())
+	return abort
+}
+
+// IsExpired reports whether the deadline of the transaction has passed
+func (e *Event) IsExpired(round int) bool {
+	return e.Deadline > 0 && round > e.Deadline
+}
+
+// Rollback pops the next stage to compensate.
+// The new event carries the remaining stack so that the rollback can proceed hierarchically.
 func (e *Event) Rollback() (Event, bool) {
-	newEvent := NewEvent()
-	newEvent.TxID = e.TxID
-	newEvent.Round = e.Round
 	dest, ok := e.PopRollbackStack()
 	// no more stack -> done!
 	if !ok {
-		newEvent.To = ServiceTxManager
-		newEvent.Phase = PhaseEnd
 		return Event{}, false
 	}
+	newEvent := NewEvent()
+	newEvent.TxID = e.TxID
+	newEvent.Round = e.Round
+	newEvent.Deadline = e.Deadline
+	newEvent.RemainingRetryTime = e.RemainingRetryTime
+	newEvent.RollbackMode = e.RollbackMode
+	newEvent.RollbackStack = append(newEvent.RollbackStack, e.RollbackStack...)
+	// the compensation finds the keys to restore in the body
+	for k, v := range e.Body {
+		newEvent.Body[k] = v
+	}
 	srv, endpoint, stage := ParseDestination(dest)
 	newEvent.Phase = PhaseRollback
 	newEvent.To = srv
@@ -138,6 +173,17 @@ func (e *Event) Get(s string) (interface{}, bool) {
 	return v, ok
 }
 
+// GetInt accepts the numbers decoded from JSON as well
+func (e *Event) GetInt(s string) (int, bool) {
+	switch v := e.Body[s].(type) {
+	case int:
+		return v, true
+	case float64:
+		return int(v), true
+	}
+	return 0, false
+}
+
 func (e *Event) Set(s string, v interface{}) {
 	e.Body[s] = v
 }
@@ -153,6 +199,11 @@ func (e *Event) Equal(e2 *Event) bool {
 func (e *Event) Print() {
 }
 
+// StageName names the stage of the endpoint of the service
+func StageName(srv, endpoint string, stage int) string {
+	return fmt.Sprintf("%s|%s|%d", srv, endpoint, stage)
+}
+
 // dest = Service|Endpoint|Stage
 func ParseDestination(dest string) (string, string, string) {
 	l := strings.Split(dest, "|")
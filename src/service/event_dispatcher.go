@@ -4,32 +4,75 @@ import "fmt"
 
 type EventFunc func(e Event) (Event, error)
 
+// StageFunc is a stage whose impure operation is written in the local transaction of the store
+type StageFunc func(tx StoreTx, e Event) (Event, error)
+
 type EventFuncChain struct {
-	chain []EventFunc
+	chain []StageFunc
+	// the compensation of each stage
+	compensations map[int]StageFunc
 }
 
 type EventDispatcher struct {
 	registry map[string]*EventFuncChain
 	eq       *EventQueue
 	srv      string
+	store    Store
 }
 
 func NewEventFuncChain() *EventFuncChain {
 	return &EventFuncChain{
-		chain: []EventFunc{},
+		chain:         []StageFunc{},
+		compensations: map[int]StageFunc{},
+	}
+}
+
+func (ef EventFunc) stage() StageFunc {
+	return func(tx StoreTx, e Event) (Event, error) {
+		return ef(e)
 	}
 }
 
 func (ec *EventFuncChain) Add(ef EventFunc) *EventFuncChain {
-	ec.chain = append(ec.chain, ef)
+	return ec.AddTx(ef.stage())
+}
+
+func (ec *EventFuncChain) AddTx(sf StageFunc) *EventFuncChain {
+	ec.chain = append(ec.chain, sf)
+	return ec
+}
+
+// AddWithCompensation adds a stage paired with its compensation.
+// After the stage succeeds, the dispatcher pushes it onto the RollbackStack.
+func (ec *EventFuncChain) AddWithCompensation(ef, cf EventFunc) *EventFuncChain {
+	return ec.AddTxWithCompensation(ef.stage(), cf.stage())
+}
+
+func (ec *EventFuncChain) AddTxWithCompensation(sf, cf StageFunc) *EventFuncChain {
+	ec.AddTx(sf)
+	return ec.CompensateTx(len(ec.chain)-1, cf)
+}
+
+// Compensate registers the function to run when the stage is rolled back
+func (ec *EventFuncChain) Compensate(stage int, cf EventFunc) *EventFuncChain {
+	return ec.CompensateTx(stage, cf.stage())
+}
+
+func (ec *EventFuncChain) CompensateTx(stage int, cf StageFunc) *EventFuncChain {
+	ec.compensations[stage] = cf
 	return ec
 }
 
+func (ec *EventFuncChain) Compensation(stage int) (StageFunc, bool) {
+	cf, ok := ec.compensations[stage]
+	return cf, ok
+}
+
 func (ec *EventFuncChain) Len() int {
 	return len(ec.chain)
 }
 
-func (ec *EventFuncChain) Select(stage int) EventFunc {
+func (ec *EventFuncChain) Select(stage int) StageFunc {
 	return ec.chain[stage]
 }
 
@@ -38,9 +81,28 @@ func NewEventDispatcher(eq *EventQueue, srv string) *EventDispatcher {
 		registry: map[string]*EventFuncChain{},
 		eq:       eq,
 		srv:      srv,
+		store:    NewMemoryStore(),
 	}
 }
 
+// SetStore replaces the store whose outbox table deduplicates the events
+func (ed *EventDispatcher) SetStore(store Store) {
+	ed.store = store
+}
+
+func (ed *EventDispatcher) Store() Store {
+	return ed.store
+}
+
+// SetOutbox replaces the outbox table of the store
+func (ed *EventDispatcher) SetOutbox(outbox Outbox) {
+	ed.store.SetOutbox(outbox)
+}
+
+func (ed *EventDispatcher) Outbox() Outbox {
+	return ed.store.Outbox()
+}
+
 func (ed *EventDispatcher) Focus(endpoint string) *EventFuncChain {
 	entry, ok := ed.registry[endpoint]
 	if !ok {
@@ -50,23 +112,75 @@ func (ed *EventDispatcher) Focus(endpoint string) *EventFuncChain {
 	return entry
 }
 
-func (ed *EventDispatcher) Enter(endpoint string, stage int, e Event) (Event, error) {
-	chain := ed.registry[endpoint]
+func (ed *EventDispatcher) Enter(tx StoreTx, endpoint string, stage int, e Event) (Event, error) {
+	chain, ok := ed.registry[endpoint]
+	if !ok {
+		return Event{}, ErrWrongEndpoint
+	}
 	if stage < 0 || stage >= chain.Len() {
 		return Event{}, ErrWrongStage
 	}
-	ef := chain.Select(stage)
-	return ef(e)
+	sf := chain.Select(stage)
+	return sf(tx, e)
 }
 
+// Dispatch processes the event in a local transaction.
+// The writes of the stage and the outbox entry are committed together before the new event is sent.
+// The pulled event is acknowledged after the new event is sent.
 func (ed *EventDispatcher) Dispatch(e Event) {
-	newEvent, err := ed.Enter(e.Endpoint, e.Stage, e)
+	defer ed.eq.Ack(ed.srv, e)
+	sys := ed.eq.sys
+	// releasing the records twice is harmless, it needs no outbox entry
+	if e.Phase == PhaseRelease {
+		ed.store.Release(e.TxID)
+		return
+	}
+	key := NewOutboxKey(e)
+	tx := ed.store.Begin(e.TxID)
+	// the event has been processed by this stage
+	if tx.HasOutbox(key) && sys.IsDeduplicated() {
+		tx.Rollback()
+		sys.LogDuplicate(ed.srv, e)
+		return
+	}
+	if e.Phase == PhaseRollback {
+		ed.compensate(tx, key, e)
+		return
+	}
+	// a committed transaction can not be aborted any more
+	if e.State != StateCommit && e.IsExpired(sys.Round()) {
+		ed.abort(tx, key, e, ErrTTLExpired)
+		return
+	}
+	newEvent, err := ed.Enter(tx, e.Endpoint, e.Stage, e)
+	if err == ErrLocked {
+		tx.Rollback()
+		ed.conflict(e)
+		return
+	}
+	if err == ErrStageFailed {
+		tx.Rollback()
+		ed.abort(ed.store.Begin(e.TxID), key, e, err)
+		return
+	}
+	if err == ErrWrongEndpoint || err == ErrWrongStage {
+		tx.Rollback()
+		ed.eq.DeadLetter(e, err)
+		return
+	}
 	if err != nil {
-		fmt.Printf("unknown dispatch: %v\n", e)
+		tx.Rollback()
+		ed.eq.DeadLetter(e, err)
 		return
 	}
+	if _, ok := ed.registry[e.Endpoint].Compensation(e.Stage); ok {
+		newEvent.PushRollbackStack(ed.srv, e.Endpoint, e.Stage)
+	}
 	newEvent.Advance()
 	newEvent.From = ed.srv
+	newEvent.Tag = sys.NewTag()
+	// a new delivery starts its backoff from the beginning
+	newEvent.CurrentRetryTime = 0
 	// call the child endpoint
 	if !newEvent.Equal(&e) {
 		newEvent.PushCallStack(e.To, e.Endpoint, e.Stage+1)
@@ -78,5 +192,105 @@ func (ed *EventDispatcher) Dispatch(e Event) {
 			newEvent.Return()
 		}
 	}
-	ed.eq.Send(newEvent)
+	ed.commit(tx, key, e, newEvent)
+}
+
+// commit writes the outbox entry and sends the new event after the local transaction succeeds
+func (ed *EventDispatcher) commit(tx StoreTx, key OutboxKey, e, newEvent Event) {
+	sys := ed.eq.sys
+	if sys.IsDeduplicated() {
+		tx.InsertOutbox(OutboxEntry{
+			Key:   key,
+			Round: sys.Round(),
+			Event: newEvent,
+		})
+	}
+	err := tx.Commit()
+	if err == ErrLocked {
+		ed.conflict(e)
+		return
+	}
+	if err != nil {
+		fmt.Printf("failed to commit: %v (%v)\n", e, err)
+		return
+	}
+	// the writes after the saga commits are never compensated, nothing waits for their locks
+	if e.State == StateCommit {
+		ed.store.Release(e.TxID)
+	}
+	if err := ed.eq.Send(newEvent); err != nil {
+		fmt.Printf("failed to send: %v (%v)\n", newEvent, err)
+	}
+}
+
+// compensate runs the compensation of the stage and acknowledges the tx manager.
+// A stage without compensation has nothing to undo.
+func (ed *EventDispatcher) compensate(tx StoreTx, key OutboxKey, e Event) {
+	sys := ed.eq.sys
+	newEvent := e
+	if chain, ok := ed.registry[e.Endpoint]; ok {
+		if cf, ok := chain.Compensation(e.Stage); ok {
+			var err error
+			newEvent, err = cf(tx, e)
+			if err != nil {
+				tx.Rollback()
+				ed.retryCompensation(e, err)
+				return
+			}
+		}
+	}
+	newEvent.Phase = PhaseRollback
+	newEvent.Advance()
+	newEvent.From = ed.srv
+	newEvent.To = ServiceTxManager
+	newEvent.Tag = sys.NewTag()
+	newEvent.CurrentRetryTime = 0
+	ed.commit(tx, key, e, newEvent)
+}
+
+// retryCompensation requeues the failed compensation with backoff.
+// The rollback cannot proceed without it, so it is dead-lettered once the retries run out.
+func (ed *EventDispatcher) retryCompensation(e Event, cause error) {
+	sys := ed.eq.sys
+	if e.RemainingRetryTime > 0 {
+		e.CurrentRetryTime++
+		e.RemainingRetryTime--
+		e.Round = NextRetryRound(sys.Round(), e.CurrentRetryTime)
+		ed.eq.Requeue(e)
+		return
+	}
+	ed.eq.DeadLetter(e, cause)
+}
+
+// conflict handles the event blocked by the semantic lock of another transaction
+func (ed *EventDispatcher) conflict(e Event) {
+	sys := ed.eq.sys
+	switch sys.ConflictPolicy() {
+	case ConflictWait:
+		// an event without a deadline would wait forever
+		if e.Deadline > 0 {
+			e.Round = sys.Round() + 1
+			ed.eq.Requeue(e)
+			return
+		}
+	case ConflictRetry:
+		if e.RemainingRetryTime > 0 {
+			e.CurrentRetryTime++
+			e.RemainingRetryTime--
+			e.Round = NextRetryRound(sys.Round(), e.CurrentRetryTime)
+			ed.eq.Requeue(e)
+			return
+		}
+	}
+	ed.abort(ed.store.Begin(e.TxID), NewOutboxKey(e), e, ErrLocked)
+}
+
+// abort asks the tx manager to abort the transaction instead of processing the event
+func (ed *EventDispatcher) abort(tx StoreTx, key OutboxKey, e Event, cause error) {
+	sys := ed.eq.sys
+	abort := e.NewAbort(cause)
+	abort.From = ed.srv
+	abort.Round = sys.Round() + 1
+	abort.Tag = sys.NewTag()
+	ed.commit(tx, key, e, abort)
 }
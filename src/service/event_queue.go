@@ -2,44 +2,572 @@ package service
 
 import (
 	"atm/ds"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
 )
 
 type EventQueue struct {
-	sys    *System
-	queues map[string]ds.Queue
+	sys *System
+	// the partitions of each service, an event goes to the partition of its TxID
+	queues map[string][]ds.Queue
+	// the instance consuming each partition
+	owners     map[string]map[int]string
+	rebalances map[string]int
+	// the round in which an instance crashed after pulling an event
+	halted map[string]int
+	// failed deliveries buffered on the sender side
+	retries map[string]ds.Queue
+	// the timed-out events whose acknowledgement has not come back, by sender
+	unacked map[string][]awaiting
+	// the events which can never be delivered
+	deadLetters []DeadLetter
+	// the events lost or kept back on the links
+	dropped []Event
+	held    map[Link]*held
+	// the pulled events which have not been acknowledged by the receiver
+	leases     map[string]map[int]*lease
+	receipt    int
+	visibility int
+	mu         sync.Mutex
+}
+
+// DeadLetter is an event dropped because its receiver cannot process it
+type DeadLetter struct {
+	Event Event
+	Cause error
+}
+
+// awaiting is a timed-out event kept by the sender until it is acknowledged
+type awaiting struct {
+	event Event
+	// whether the event has reached the queue of the receiver
+	arrived bool
+}
+
+type lease struct {
+	item      *ds.Item
+	partition int
+	deadline  int
 }
 
 func NewEventQueue(sys *System) *EventQueue {
-	queues := map[string]ds.Queue{
-		ServiceTxManager:    ds.NewMutexTimedPriorityQueue(&sys.Cfg.round),
-		ServicePayment:      ds.NewMutexTimedPriorityQueue(&sys.Cfg.round),
-		ServiceOrder:        ds.NewMutexTimedPriorityQueue(&sys.Cfg.round),
-		ServiceShipping:     ds.NewMutexTimedPriorityQueue(&sys.Cfg.round),
-		ServiceCustomer:     ds.NewMutexTimedPriorityQueue(&sys.Cfg.round),
-		ServiceNotification: ds.NewMutexTimedPriorityQueue(&sys.Cfg.round),
+	eq := &EventQueue{
+		sys:         sys,
+		queues:      map[string][]ds.Queue{},
+		owners:      map[string]map[int]string{},
+		rebalances:  map[string]int{},
+		halted:      map[string]int{},
+		retries:     map[string]ds.Queue{},
+		unacked:     map[string][]awaiting{},
+		leases:      map[string]map[int]*lease{},
+		visibility:  DefaultVisibilityTimeout,
+		deadLetters: []DeadLetter{},
+		dropped:     []Event{},
+		held:        map[Link]*held{},
+	}
+	return eq
+}
+
+// Register creates the queue of the service
+func (eq *EventQueue) Register(srv string) {
+	if _, ok := eq.queues[srv]; !ok {
+		eq.SetPartitions(srv, 1)
 	}
+}
 
-	return &EventQueue{
-		sys:    sys,
-		queues: queues,
+// DeadLetter drops the event which can never be processed
+// and asks the tx manager to abort the transaction instead of waiting for its deadline.
+func (eq *EventQueue) DeadLetter(e Event, cause error) {
+	eq.mu.Lock()
+	eq.deadLetters = append(eq.deadLetters, DeadLetter{Event: e, Cause: cause})
+	eq.mu.Unlock()
+	eq.sys.Report().AddDeadLetter(eq.sys.Round(), e, cause)
+	// the transaction is already rolling back or there is nobody to abort it
+	if e.TxID == "" || e.To == ServiceTxManager || e.Phase == PhaseRollback {
+		return
+	}
+	abort := e.NewAbort(cause)
+	abort.From = e.From
+	abort.Round = eq.sys.Round() + 1
+	abort.Tag = eq.sys.NewTag()
+	if err := eq.Send(abort); err != nil {
+		fmt.Printf("failed to abort: %v (%v)\n", abort, err)
 	}
 }
 
+func (eq *EventQueue) DeadLetters() []DeadLetter {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	deadLetters := make([]DeadLetter, len(eq.deadLetters))
+	copy(deadLetters, eq.deadLetters)
+	return deadLetters
+}
+
 func (eq *EventQueue) Name() string {
 	return ServiceEventQueue
 }
 
-func (eq *EventQueue) Send(e Event) {
+// SetPartitions splits the queue of the service, the events in the old queue are dropped.
+// It should be called before any event is sent.
+func (eq *EventQueue) SetPartitions(srv string, n int) {
+	if n < 1 {
+		n = 1
+	}
+	partitions := make([]ds.Queue, n)
+	for p := range partitions {
+		partitions[p] = ds.NewMutexTimedPriorityQueue(&eq.sys.Cfg.round)
+	}
+	eq.queues[srv] = partitions
+	eq.mu.Lock()
+	delete(eq.owners, srv)
+	eq.mu.Unlock()
+}
+
+func (eq *EventQueue) Partitions(srv string) int {
+	return len(eq.queues[srv])
+}
+
+// Partition returns the partition of the transaction in the queue of the service
+func (eq *EventQueue) Partition(srv, txid string) int {
+	h := fnv.New32a()
+	h.Write([]byte(txid))
+	return int(h.Sum32() % uint32(len(eq.queues[srv])))
+}
+
+func (eq *EventQueue) queue(e Event) ds.Queue {
+	return eq.queues[e.To][eq.Partition(e.To, e.TxID)]
+}
+
+// SetLogDir makes each partition durable with a segment log in the directory.
+// The events left in an existing log are replayed.
+func (eq *EventQueue) SetLogDir(dir string) error {
+	for srv, partitions := range eq.queues {
+		for p := range partitions {
+			log, err := ds.OpenSegmentLog(filepath.Join(dir, srv, strconv.Itoa(p)), ds.DefaultSegmentSize)
+			if err != nil {
+				return err
+			}
+			queue, err := NewLogQueue(log, srv, &eq.sys.Cfg.round)
+			if err != nil {
+				log.Close()
+				return err
+			}
+			partitions[p] = queue
+		}
+	}
+	return nil
+}
+
+// SetVisibilityTimeout sets the rounds a pulled event waits for its acknowledgement
+func (eq *EventQueue) SetVisibilityTimeout(rounds int) {
+	eq.visibility = rounds
+}
+
+// Crash loses the events kept in memory
+func (eq *EventQueue) Crash() {
+	eq.mu.Lock()
+	eq.leases = map[string]map[int]*lease{}
+	// the events held back on the links are not in the logs yet
+	links := []Link{}
+	for link := range eq.held {
+		links = append(links, link)
+	}
+	eq.mu.Unlock()
+	sortLinks(links)
+	for _, link := range links {
+		eq.mu.Lock()
+		h := eq.held[link]
+		delete(eq.held, link)
+		eq.mu.Unlock()
+		eq.drop(h.event)
+	}
+	for _, partitions := range eq.queues {
+		for p, queue := range partitions {
+			if lq, ok := queue.(*LogQueue); ok {
+				lq.Crash()
+				continue
+			}
+			partitions[p] = ds.NewMutexTimedPriorityQueue(&eq.sys.Cfg.round)
+		}
+	}
+}
+
+// Restart replays the events which have not been acknowledged from the durable logs
+func (eq *EventQueue) Restart() error {
+	for _, partitions := range eq.queues {
+		for _, queue := range partitions {
+			if lq, ok := queue.(*LogQueue); ok {
+				if err := lq.Recover(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (eq *EventQueue) Close() error {
+	var err error
+	for _, partitions := range eq.queues {
+		for _, queue := range partitions {
+			if lq, ok := queue.(*LogQueue); ok {
+				if cerr := lq.Close(); cerr != nil && err == nil {
+					err = cerr
+				}
+			}
+		}
+	}
+	return err
+}
+
+// Send delivers the event to the queue of the receiver.
+// A failed delivery is retried with exponential backoff until the retry budget of the event runs out.
+// Then the transaction is aborted through the tx manager and ErrTooManyRetries is returned.
+// A delivery which times out is kept by the sender and sent again until it is acknowledged.
+// An event sent to an unknown service is dead-lettered without retries.
+func (eq *EventQueue) Send(e Event) error {
+	if _, ok := eq.queues[e.To]; !ok {
+		eq.DeadLetter(e, ErrUnknownService)
+		return ErrUnknownService
+	}
+	arrived, err := eq.deliver(e)
+	if err == ErrTimeout {
+		eq.await(e, arrived)
+		return nil
+	}
+	if err != nil {
+		return eq.retry(e, err)
+	}
+	return nil
+}
+
+// SendOnce delivers the event without retries, the sender is expected to send it again
+func (eq *EventQueue) SendOnce(e Event) error {
+	if _, ok := eq.queues[e.To]; !ok {
+		eq.DeadLetter(e, ErrUnknownService)
+		return ErrUnknownService
+	}
+	_, err := eq.deliver(e)
+	return err
+}
+
+// Flush delivers the buffered events of the sender whose retry round has come
+func (eq *EventQueue) Flush(srv string) {
+	eq.acknowledge(srv)
+	queue, ok := eq.retries[srv]
+	if !ok {
+		return
+	}
+	for {
+		item, ok := queue.Pop().(*ds.Item)
+		if !ok {
+			break
+		}
+		e := item.Value().(Event)
+		if err := eq.Send(e); err != nil {
+			fmt.Printf("failed to retry: %v (%v)\n", e, err)
+		}
+	}
+}
+
+// deliver fails if the event queue crashed or the link of the sender is broken.
+// It reports whether the event has arrived, on ErrTimeout the sender does not know it.
+func (eq *EventQueue) deliver(e Event) (bool, error) {
+	if eq.sys.IsCrashed(ServiceEventQueue) {
+		return false, ErrServiceCrash
+	}
+	if eq.sys.IsLinkBroken(e.From) {
+		return false, ErrLinkBroken
+	}
+	linkErr := eq.sys.LinkError(e.From, e.To)
+	if linkErr == ErrLinkBroken {
+		return false, linkErr
+	}
+	e.Receipt = 0
+	// the event arrives after the latency of the link, or never
+	profile := eq.sys.LinkProfile(e.From, e.To)
+	e.Round += eq.sys.Delay(profile.Latency)
+	if eq.sys.Chance(profile.DropRate) {
+		eq.drop(e)
+		return false, linkErr
+	}
+	link := Link{From: e.From, To: e.To}
+	if !eq.isHolding(link) && eq.sys.Chance(profile.ReorderRate) {
+		eq.hold(link, e)
+		return true, linkErr
+	}
+	eq.push(e)
+	eq.release(link, e.Round)
+	return true, linkErr
+}
+
+func (eq *EventQueue) push(e Event) {
 	eq.sys.Log(e.To, e)
-	eq.queues[e.To].Push(ds.NewItem(e.Round, e))
+	eq.queue(e).Push(ds.NewItem(e.Round, e))
+	// the sender fails to acknowledge the old event and sends the new event again
+	if eq.sys.Chance(eq.sys.DuplicateRate()) {
+		eq.sys.Log(e.To, e)
+		eq.queue(e).Push(ds.NewItem(e.Round, e))
+	}
+}
+
+// await keeps the timed-out event until its acknowledgement comes back to the sender
+func (eq *EventQueue) await(e Event, arrived bool) {
+	e.Round = eq.sys.Round() + eq.visibility
+	eq.unacked[e.From] = append(eq.unacked[e.From], awaiting{event: e, arrived: arrived})
+}
+
+// acknowledge checks the events awaiting their acknowledgement whose visibility timeout has passed.
+// The acknowledgement comes back once the event has arrived and the link back to the sender heals,
+// otherwise the sender sends the event again and the receiver drops the duplicates.
+// The transaction is never aborted since the event may have arrived.
+func (eq *EventQueue) acknowledge(srv string) {
+	events := eq.unacked[srv]
+	eq.unacked[srv] = nil
+	round := eq.sys.Round()
+	for _, a := range events {
+		if a.event.Round > round {
+			eq.unacked[srv] = append(eq.unacked[srv], a)
+			continue
+		}
+		if a.arrived && !eq.sys.IsPartitioned(a.event.To, a.event.From) {
+			continue
+		}
+		e := a.event
+		e.Round = round
+		arrived, err := eq.deliver(e)
+		if arrived && err == nil {
+			continue
+		}
+		eq.await(e, a.arrived || arrived)
+	}
+}
+
+// Unacked returns the number of timed-out events of the sender still awaiting their acknowledgement
+func (eq *EventQueue) Unacked(srv string) int {
+	return len(eq.unacked[srv])
+}
+
+func (eq *EventQueue) retry(e Event, cause error) error {
+	if e.RemainingRetryTime <= 0 {
+		return eq.escalate(e, cause)
+	}
+	e.CurrentRetryTime++
+	e.RemainingRetryTime--
+	e.Round = NextRetryRound(eq.sys.Round(), e.CurrentRetryTime)
+	queue, ok := eq.retries[e.From]
+	if !ok {
+		queue = ds.NewMutexTimedPriorityQueue(&eq.sys.Cfg.round)
+		eq.retries[e.From] = queue
+	}
+	queue.Push(ds.NewItem(e.Round, e))
+	return nil
+}
+
+// escalate asks the tx manager to abort the transaction of an undeliverable event
+func (eq *EventQueue) escalate(e Event, cause error) error {
+	// there is nobody left to report the failure of an abort
+	if e.To == ServiceTxManager && e.State == StateAbort {
+		return ErrUnrecoverable
+	}
+	abort := e.NewAbort(cause)
+	abort.From = e.From
+	abort.Round = eq.sys.Round() + 1
+	abort.Tag = eq.sys.NewTag()
+	if err := eq.Send(abort); err != nil {
+		return err
+	}
+	return ErrTooManyRetries
+}
+
+// Requeue puts a pulled event back to be processed again at e.Round
+func (eq *EventQueue) Requeue(e Event) {
+	e.Receipt = 0
+	eq.queue(e).Push(ds.NewItem(e.Round, e))
 }
 
+// Consume is the receive loop of a service: it flushes the retries of the service
+// and handles the events pulled in the round. It returns false if the service crashed.
+func (eq *EventQueue) Consume(srv string, handle func(Event)) bool {
+	if eq.sys.IsCrashed(srv) {
+		return false
+	}
+	eq.Flush(srv)
+	for {
+		e, err := eq.Pull(srv)
+		if err != nil {
+			break
+		}
+		handle(e)
+	}
+	return true
+}
+
+// Pull leases the next event from the partitions owned by the live instances of the service.
+// The event is invisible to the other pulls until it is acknowledged or its lease expires,
+// then it is delivered again.
+// The events held back on the links to the service longer than the reorder window arrive first.
 func (eq *EventQueue) Pull(srv string) (Event, error) {
-	// fmt.Printf("srv: %s - clock: %d\n", srv, *eq.clock)
-	item, ok := eq.queues[srv].Pop().(*ds.Item)
+	if eq.sys.IsCrashed(ServiceEventQueue) {
+		return Event{}, ErrServiceCrash
+	}
+	eq.releaseExpired(srv)
+	eq.expire(srv)
+	round := eq.sys.Round()
+	owners := eq.rebalance(srv)
+	for p, queue := range eq.queues[srv] {
+		instance, ok := owners[p]
+		if !ok {
+			continue
+		}
+		if eq.isHalted(instance, round) {
+			continue
+		}
+		// fmt.Printf("srv: %s - clock: %d\n", srv, *eq.clock)
+		item, ok := queue.Pop().(*ds.Item)
+		if !ok {
+			continue
+		}
+		e := eventOf(item)
+		eq.mu.Lock()
+		eq.receipt++
+		e.Receipt = eq.receipt
+		leases, ok := eq.leases[srv]
+		if !ok {
+			leases = map[int]*lease{}
+			eq.leases[srv] = leases
+		}
+		leases[e.Receipt] = &lease{
+			item:      item,
+			partition: p,
+			deadline:  round + eq.visibility,
+		}
+		eq.mu.Unlock()
+		// the event is lost with the service before it is processed
+		if eq.sys.IsCrashedAfterPull(srv) {
+			return Event{}, ErrServiceCrash
+		}
+		// the other instances keep pulling
+		if eq.sys.IsCrashedAfterPull(instance) {
+			eq.mu.Lock()
+			eq.halted[instance] = round
+			eq.mu.Unlock()
+			continue
+		}
+		return e, nil
+	}
+	return Event{}, ErrEmptyQueue
+}
+
+// rebalance assigns the partitions of the service to its live instances in turn.
+// The partitions of a crashed instance are taken over by the others.
+func (eq *EventQueue) rebalance(srv string) map[int]string {
+	live := eq.sys.LiveInstances(srv)
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	owners := map[int]string{}
+	if len(live) > 0 {
+		for p := range eq.queues[srv] {
+			owners[p] = live[p%len(live)]
+		}
+	}
+	prev, ok := eq.owners[srv]
+	if ok && !sameOwners(prev, owners) {
+		eq.rebalances[srv]++
+	}
+	eq.owners[srv] = owners
+	return owners
+}
+
+// isHalted reports whether the instance crashed in the round after pulling an event
+func (eq *EventQueue) isHalted(instance string, round int) bool {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	halted, ok := eq.halted[instance]
+	return ok && halted == round
+}
+
+func sameOwners(a, b map[int]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for p, instance := range a {
+		if b[p] != instance {
+			return false
+		}
+	}
+	return true
+}
+
+// Owners returns the instance consuming each partition of the service at the last pull
+func (eq *EventQueue) Owners(srv string) map[int]string {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	owners := map[int]string{}
+	for p, instance := range eq.owners[srv] {
+		owners[p] = instance
+	}
+	return owners
+}
+
+// Rebalances returns how many times the partitions of the service have been reassigned
+func (eq *EventQueue) Rebalances(srv string) int {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	return eq.rebalances[srv]
+}
+
+// Ack removes the pulled event after the receiver has sent the next event.
+// An event whose lease has expired may have been delivered again, so its late ack fails.
+func (eq *EventQueue) Ack(srv string, e Event) error {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	l, ok := eq.leases[srv][e.Receipt]
 	if !ok {
-		return Event{}, ErrEmptyQueue
+		return ErrLeaseExpired
+	}
+	delete(eq.leases[srv], e.Receipt)
+	if lq, ok := eq.queues[srv][l.partition].(*LogQueue); ok {
+		lq.Ack(l.item)
+	}
+	return nil
+}
+
+// expire makes the events whose lease has expired visible again
+func (eq *EventQueue) expire(srv string) {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	receipts := []int{}
+	for receipt, l := range eq.leases[srv] {
+		if l.deadline <= eq.sys.Round() {
+			receipts = append(receipts, receipt)
+		}
+	}
+	// redeliver in the order of the pulls
+	sort.Ints(receipts)
+	for _, receipt := range receipts {
+		l := eq.leases[srv][receipt]
+		eq.queues[srv][l.partition].Push(l.item)
+		delete(eq.leases[srv], receipt)
+	}
+}
+
+// Leased returns the number of events pulled by the service and not acknowledged
+func (eq *EventQueue) Leased(srv string) int {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	return len(eq.leases[srv])
+}
+
+// Len returns the number of events which are ready to be pulled by the service
+func (eq *EventQueue) Len(srv string) int {
+	n := 0
+	for _, queue := range eq.queues[srv] {
+		n += queue.Len()
 	}
-	e := item.Value().(Event)
-	return e, nil
+	return n
 }
@@ -3,6 +3,7 @@ package service
 import (
 	"atm/ds"
 	"fmt"
+	"sync"
 	"sync/atomic"
 )
 
@@ -10,12 +11,16 @@ type RoundGateway struct {
 	sys   *System
 	queue *ds.MutexQueue
 	txNum uint64
+	// idempotency key -> TxID
+	keys map[string]string
+	mu   sync.Mutex
 }
 
 func NewRoundGateway(sys *System) *RoundGateway {
 	return &RoundGateway{
 		sys:   sys,
 		queue: ds.NewMutexTimedPriorityQueue(&sys.Cfg.round),
+		keys:  map[string]string{},
 	}
 }
 
@@ -23,21 +28,62 @@ func (rgtw *RoundGateway) Name() string {
 	return ServiceGateway
 }
 
-func (rgtw *RoundGateway) Send(req Request, round int) {
+// Send accepts the request and returns the TxID to query the transaction
+// A retried request with a known idempotency key is not sent again.
+func (rgtw *RoundGateway) Send(req Request, round int) string {
+	rgtw.mu.Lock()
+	defer rgtw.mu.Unlock()
+	if txid, ok := rgtw.keys[req.IdempotencyKey]; ok && req.IdempotencyKey != "" {
+		return txid
+	}
+	if req.TxID == "" {
+		req.TxID = fmt.Sprintf("tx-%d", atomic.AddUint64(&rgtw.txNum, 1))
+	}
+	if req.IdempotencyKey != "" {
+		rgtw.keys[req.IdempotencyKey] = req.TxID
+	}
 	rgtw.queue.Push(ds.NewItem(round, req))
+	return req.TxID
+}
+
+func (rgtw *RoundGateway) Query(txid string) (TxStatus, bool) {
+	tm := rgtw.sys.TxManager()
+	if tm == nil {
+		return TxStatus{}, false
+	}
+	return tm.Status(txid)
+}
+
+func (rgtw *RoundGateway) QueryByState(state State) []TxStatus {
+	tm := rgtw.sys.TxManager()
+	if tm == nil {
+		return []TxStatus{}
+	}
+	return tm.StatusByState(state)
+}
+
+func (rgtw *RoundGateway) QueryAll() []TxStatus {
+	tm := rgtw.sys.TxManager()
+	if tm == nil {
+		return []TxStatus{}
+	}
+	return tm.Statuses()
 }
 
-// gateway is always available
+// the failed requests are retried by the event queue
 func (rgtw *RoundGateway) Receive() {
+	if rgtw.sys.IsCrashed(ServiceGateway) {
+		return
+	}
 	eq := rgtw.sys.EventQueue
+	eq.Flush(ServiceGateway)
 	for !rgtw.queue.IsEmpty() {
 		item := rgtw.queue.Pop().(*ds.Item)
 		req := item.Value().(Request)
 		e := rgtw.initEvent(req)
-		if e.TxID == "" {
-			e.TxID = fmt.Sprintf("tx-%d", atomic.AddUint64(&rgtw.txNum, 1))
+		if err := eq.Send(e); err != nil {
+			fmt.Printf("failed to send: %v (%v)\n", e, err)
 		}
-		eq.Send(e)
 	}
 }
 
@@ -47,9 +93,21 @@ func (rgtw *RoundGateway) initEvent(req Request) Event {
 	e.From = ServiceGateway
 	e.To = ServiceTxManager
 	e.PushCallStack(req.Service, req.Endpoint, 0)
+	for k, v := range req.Body {
+		e.Set(k, v)
+	}
 	e.CurrentRetryTime = 0
 	e.RemainingRetryTime = DefaultRetryTime
 	e.Round = rgtw.sys.Round() + 1
+	e.Deadline = e.Round + req.TTL
+	if req.TTL <= 0 {
+		e.Deadline = e.Round + DefaultTTL
+	}
+	e.Tag = rgtw.sys.NewTag()
 	e.Phase = PhaseBegin
+	e.RollbackMode = req.RollbackMode
+	if e.RollbackMode == RollbackDefault {
+		e.RollbackMode = rgtw.sys.RollbackMode()
+	}
 	return e
 }
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"atm/ds"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// JournalRecord is a change of the status of a transaction written ahead to the journal of the tx manager
+type JournalRecord struct {
+	Status     TxStatus    `json:"status"`
+	Transition *Transition `json:"transition,omitempty"`
+	// the last event of the transaction to compensate on expiry
+	Latest *Event `json:"latest,omitempty"`
+	// the event handled by the change with the events sent after it is journaled
+	Handled *OutboxEntry `json:"handled,omitempty"`
+	// a snapshot record replaces the whole history and the handled events of the transaction
+	Snapshot bool          `json:"snapshot,omitempty"`
+	History  []Transition  `json:"history,omitempty"`
+	Outbox   []OutboxEntry `json:"outbox,omitempty"`
+}
+
+// SetJournal replaces the journal and rebuilds the transactions from its records
+func (tm *TxManager) SetJournal(journal ds.Log) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.journal = journal
+	return tm.replay()
+}
+
+// SetJournalDir keeps the journal in a segment log under the directory
+func (tm *TxManager) SetJournalDir(dir string) error {
+	journal, err := ds.OpenSegmentLog(filepath.Join(dir, ServiceTxManager), ds.DefaultSegmentSize)
+	if err != nil {
+		return err
+	}
+	if err := tm.SetJournal(journal); err != nil {
+		journal.Close()
+		return err
+	}
+	return nil
+}
+
+func (tm *TxManager) Journal() ds.Log {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.journal
+}
+
+func (tm *TxManager) Close() error {
+	return tm.Journal().Close()
+}
+
+// Crash loses the transactions kept in memory, the journal is left untouched
+func (tm *TxManager) Crash() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.reset()
+}
+
+// Restart rebuilds the transactions from the journal
+func (tm *TxManager) Restart() error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.replay()
+}
+
+// reset must be called with the lock held
+func (tm *TxManager) reset() {
+	tm.progress = map[string]*TxStatus{}
+	tm.history = map[string][]Transition{}
+	tm.latest = map[string]Event{}
+	tm.releasing = map[string]Event{}
+	tm.handled = map[string][]OutboxEntry{}
+	tm.served = map[OutboxKey]bool{}
+	tm.outbox.Clear()
+}
+
+// replay starts from the last snapshot, it must be called with the lock held
+func (tm *TxManager) replay() error {
+	tm.reset()
+	for offset := tm.journal.Offset(ServiceTxManager); offset < tm.journal.End(); offset++ {
+		data, err := tm.journal.Read(offset)
+		if err != nil {
+			return err
+		}
+		// an empty record changes nothing
+		if len(data) == 0 {
+			continue
+		}
+		record := JournalRecord{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		tm.apply(record)
+	}
+	return nil
+}
+
+// write appends the record to the journal before applying it.
+// The change is lost if it cannot be journaled. It must be called with the lock held.
+func (tm *TxManager) write(record JournalRecord) error {
+	if err := tm.append(record); err != nil {
+		fmt.Printf("failed to journal: %s (%v)\n", record.Status.TxID, err)
+		return fmt.Errorf("%w: %v", ErrJournal, err)
+	}
+	tm.apply(record)
+	if tm.journal.End()-tm.journal.Offset(ServiceTxManager) > tm.compaction+len(tm.progress) {
+		if err := tm.compact(); err != nil {
+			fmt.Printf("failed to compact the journal: %v\n", err)
+		}
+	}
+	return nil
+}
+
+func (tm *TxManager) append(record JournalRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = tm.journal.Append(data)
+	return err
+}
+
+// compact writes a snapshot record of each transaction and replays from the snapshot after restart,
+// so the replay is bounded by the transactions instead of all their changes.
+// A snapshot torn by a crash is harmless, the replay starts from the previous one.
+// It must be called with the lock held.
+func (tm *TxManager) compact() error {
+	start := tm.journal.End()
+	txids := []string{}
+	for txid := range tm.progress {
+		txids = append(txids, txid)
+	}
+	sort.Strings(txids)
+	for _, txid := range txids {
+		record := JournalRecord{
+			Status:   *tm.progress[txid],
+			Snapshot: true,
+			History:  tm.history[txid],
+			Outbox:   tm.handled[txid],
+		}
+		if latest, ok := tm.latest[txid]; ok {
+			record.Latest = &latest
+		}
+		if err := tm.append(record); err != nil {
+			return err
+		}
+	}
+	return tm.journal.Commit(ServiceTxManager, start)
+}
+
+// SetCompaction sets the number of records journaled between two snapshots besides one for each transaction
+func (tm *TxManager) SetCompaction(n int) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.compaction = n
+}
+
+// apply must be called with the lock held
+func (tm *TxManager) apply(record JournalRecord) {
+	status := record.Status
+	tm.progress[status.TxID] = &status
+	if record.Snapshot {
+		tm.history[status.TxID] = append([]Transition{}, record.History...)
+		tm.handled[status.TxID] = append([]OutboxEntry{}, record.Outbox...)
+		for _, entry := range record.Outbox {
+			tm.outbox.Insert(entry)
+		}
+	}
+	if record.Handled != nil {
+		tm.insert(*record.Handled)
+	}
+	if record.Transition != nil {
+		tm.history[status.TxID] = append(tm.history[status.TxID], *record.Transition)
+		// the services may lose the release of a finished transaction, it is sent again a few times
+		if to := record.Transition.To; to == StateComplete || to == StateAborted {
+			tm.releasing[status.TxID] = Event{
+				TxID:               status.TxID,
+				State:              to,
+				Round:              NextRetryRound(record.Transition.Round, 1),
+				CurrentRetryTime:   1,
+				RemainingRetryTime: DefaultReleaseRetryTime,
+			}
+		}
+	}
+	if record.Latest != nil {
+		tm.latest[status.TxID] = *record.Latest
+	}
+	// a finished transaction never expires
+	if status.State == StateComplete || status.State == StateAborted {
+		delete(tm.latest, status.TxID)
+	}
+}
+
+// insert keeps the handled event in the outbox, it must be called with the lock held
+func (tm *TxManager) insert(entry OutboxEntry) {
+	if tm.outbox.Insert(entry) {
+		tm.handled[entry.Key.TxID] = append(tm.handled[entry.Key.TxID], entry)
+	}
+}
@@ -0,0 +1,73 @@
+package service
+
+import "sort"
+
+// Link is the direction of the communication from a component to another one
+type Link struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// PartitionLink stops the events sent from one component to another
+func (sys *System) PartitionLink(from, to string) {
+	sys.Cfg.linkMu.Lock()
+	defer sys.Cfg.linkMu.Unlock()
+	sys.Cfg.partitions[Link{From: from, To: to}] = true
+}
+
+func (sys *System) HealLink(from, to string) {
+	sys.Cfg.linkMu.Lock()
+	defer sys.Cfg.linkMu.Unlock()
+	delete(sys.Cfg.partitions, Link{From: from, To: to})
+}
+
+// SetPartitionedLinks replaces the partitioned links, the others are healed
+func (sys *System) SetPartitionedLinks(links []Link) {
+	sys.Cfg.linkMu.Lock()
+	defer sys.Cfg.linkMu.Unlock()
+	sys.Cfg.partitions = map[Link]bool{}
+	for _, link := range links {
+		sys.Cfg.partitions[link] = true
+	}
+}
+
+// PartitionedLinks returns the partitioned links in a stable order
+func (sys *System) PartitionedLinks() []Link {
+	sys.Cfg.linkMu.Lock()
+	defer sys.Cfg.linkMu.Unlock()
+	links := []Link{}
+	for link := range sys.Cfg.partitions {
+		links = append(links, link)
+	}
+	sortLinks(links)
+	return links
+}
+
+func sortLinks(links []Link) {
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].From != links[j].From {
+			return links[i].From < links[j].From
+		}
+		return links[i].To < links[j].To
+	})
+}
+
+func (sys *System) IsPartitioned(from, to string) bool {
+	sys.Cfg.linkMu.Lock()
+	defer sys.Cfg.linkMu.Unlock()
+	return sys.Cfg.partitions[Link{From: from, To: to}]
+}
+
+// LinkError returns the error seen by the sender of an event.
+// The event does not arrive if the link to the receiver is partitioned.
+// If only the link back to the sender is partitioned, the event arrives
+// but its acknowledgement is lost, so the sender times out.
+func (sys *System) LinkError(from, to string) error {
+	if sys.IsPartitioned(from, to) {
+		return ErrLinkBroken
+	}
+	if sys.IsPartitioned(to, from) {
+		return ErrTimeout
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package service_test
+
+import (
+	"atm/service"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkError(t *testing.T) {
+	sys := service.NewSystem()
+	assert.Nil(t, sys.LinkError(service.ServiceOrder, service.ServiceShipping))
+
+	// the event does not arrive through the partition, its acknowledgement does not come back
+	sys.PartitionLink(service.ServiceOrder, service.ServiceShipping)
+	assert.Equal(t, service.ErrLinkBroken, sys.LinkError(service.ServiceOrder, service.ServiceShipping))
+	assert.Equal(t, service.ErrTimeout, sys.LinkError(service.ServiceShipping, service.ServiceOrder))
+
+	sys.PartitionLink(service.ServicePayment, service.ServiceOrder)
+	assert.Equal(t, []service.Link{
+		{From: service.ServiceOrder, To: service.ServiceShipping},
+		{From: service.ServicePayment, To: service.ServiceOrder},
+	}, sys.PartitionedLinks())
+
+	sys.HealLink(service.ServiceOrder, service.ServiceShipping)
+	assert.Nil(t, sys.LinkError(service.ServiceOrder, service.ServiceShipping))
+	sys.SetPartitionedLinks(nil)
+	assert.Empty(t, sys.PartitionedLinks())
+}
+
+func TestSendTimeout(t *testing.T) {
+	sys := service.NewSystem()
+	eq := sys.EventQueue
+	sys.PartitionLink(service.ServiceShipping, service.ServiceOrder)
+
+	e := service.NewEvent()
+	e.TxID = "tx-1"
+	e.From = service.ServiceOrder
+	e.To = service.ServiceShipping
+	e.Endpoint = "shipping"
+	e.Round = sys.Round()
+	assert.Nil(t, eq.Send(e))
+	assert.Equal(t, 1, eq.Unacked(service.ServiceOrder))
+
+	received := 0
+	step := func() {
+		sys.Advance()
+		eq.Flush(service.ServiceOrder)
+		for {
+			e, err := eq.Pull(service.ServiceShipping)
+			if err != nil {
+				break
+			}
+			received++
+			assert.Nil(t, eq.Ack(service.ServiceShipping, e))
+		}
+	}
+
+	// the sender sends the event again after each visibility timeout while the link back stays partitioned
+	for i := 0; i < 20; i++ {
+		step()
+	}
+	assert.Equal(t, 1, eq.Unacked(service.ServiceOrder))
+	assert.Equal(t, 1+20/service.DefaultVisibilityTimeout, received)
+
+	// the acknowledgement comes back once the link heals, the event is not sent again
+	sys.HealLink(service.ServiceShipping, service.ServiceOrder)
+	resent := received
+	for i := 0; i < 40; i++ {
+		step()
+	}
+	assert.Zero(t, eq.Unacked(service.ServiceOrder))
+	assert.LessOrEqual(t, received, resent+1)
+	assert.Empty(t, eq.DeadLetters())
+}
+
+func TestSendTimeoutDropped(t *testing.T) {
+	sys := service.NewSystem()
+	eq := sys.EventQueue
+	sys.PartitionLink(service.ServiceShipping, service.ServiceOrder)
+	assert.Nil(t, sys.SetLinkProfile(service.ServiceOrder, service.ServiceShipping, service.LinkProfile{DropRate: 1}))
+
+	e := service.NewEvent()
+	e.TxID = "tx-1"
+	e.From = service.ServiceOrder
+	e.To = service.ServiceShipping
+	e.Endpoint = "shipping"
+	e.Round = sys.Round()
+	assert.Nil(t, eq.Send(e))
+	assert.Equal(t, 1, len(eq.Dropped()))
+	assert.Equal(t, 1, eq.Unacked(service.ServiceOrder))
+
+	// the timed-out event is sent again after the visibility timeout although it was lost
+	assert.Nil(t, sys.SetLinkProfile(service.ServiceOrder, service.ServiceShipping, service.LinkProfile{}))
+	sys.HealLink(service.ServiceShipping, service.ServiceOrder)
+	received := 0
+	for i := 0; i < 2*service.DefaultVisibilityTimeout; i++ {
+		sys.Advance()
+		eq.Flush(service.ServiceOrder)
+		for {
+			e, err := eq.Pull(service.ServiceShipping)
+			if err != nil {
+				break
+			}
+			received++
+			assert.Equal(t, "tx-1", e.TxID)
+			assert.Nil(t, eq.Ack(service.ServiceShipping, e))
+		}
+	}
+	assert.Equal(t, 1, received)
+	assert.Zero(t, eq.Unacked(service.ServiceOrder))
+}
+
+func TestEventQueueCrashDropsHeld(t *testing.T) {
+	sys := service.NewSystem()
+	assert.Nil(t, sys.SetLinkProfile(service.ServiceOrder, service.ServiceShipping, service.LinkProfile{ReorderRate: 1}))
+	e := service.NewEvent()
+	e.TxID = "tx-1"
+	e.From = service.ServiceOrder
+	e.To = service.ServiceShipping
+	assert.Nil(t, sys.EventQueue.Send(e))
+	assert.Equal(t, 1, sys.EventQueue.Held())
+
+	// the held event is lost with the event queue
+	sys.EventQueue.Crash()
+	assert.Zero(t, sys.EventQueue.Held())
+	assert.Equal(t, 1, len(sys.EventQueue.Dropped()))
+}
+
+func TestHeldSenderCrash(t *testing.T) {
+	sys := service.NewSystem()
+	eq := sys.EventQueue
+	assert.Nil(t, sys.SetLinkProfile(service.ServiceOrder, service.ServiceShipping, service.LinkProfile{ReorderRate: 1}))
+	e := service.NewEvent()
+	e.TxID = "tx-1"
+	e.From = service.ServiceOrder
+	e.To = service.ServiceShipping
+	e.Round = sys.Round()
+	assert.Nil(t, eq.Send(e))
+	assert.Equal(t, 1, eq.Held())
+
+	// the sender crashes and never flushes, the held event still arrives after the reorder window
+	assert.Nil(t, sys.SetFailure(service.ServiceOrder, service.FailureCrash))
+	for i := 1; i < service.DefaultReorderWindow; i++ {
+		sys.Advance()
+		_, err := eq.Pull(service.ServiceShipping)
+		assert.ErrorIs(t, err, service.ErrEmptyQueue)
+	}
+	sys.Advance()
+	received, err := eq.Pull(service.ServiceShipping)
+	assert.Nil(t, err)
+	assert.Equal(t, "tx-1", received.TxID)
+	assert.Zero(t, eq.Held())
+	assert.Empty(t, eq.Dropped())
+}
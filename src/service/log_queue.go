@@ -0,0 +1,155 @@
+package service
+
+import (
+	"atm/ds"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+type logRecord struct {
+	offset int
+	event  Event
+}
+
+// eventOf returns the event of an item popped from a memory queue or a LogQueue
+func eventOf(item *ds.Item) Event {
+	if record, ok := item.Value().(logRecord); ok {
+		return record.event
+	}
+	return item.Value().(Event)
+}
+
+// LogQueue is a durable queue of events backed by a log.
+// An acknowledged event commits the offset of the consumer,
+// and the events after the committed offset are replayed on recovery.
+type LogQueue struct {
+	log      ds.Log
+	consumer string
+	round    *int
+	queue    ds.Queue
+	// the offsets acknowledged after the committed offset
+	acked map[int]bool
+	mu    sync.Mutex
+}
+
+func NewLogQueue(log ds.Log, consumer string, round *int) (*LogQueue, error) {
+	lq := &LogQueue{
+		log:      log,
+		consumer: consumer,
+		round:    round,
+	}
+	if err := lq.Recover(); err != nil {
+		return nil, err
+	}
+	return lq, nil
+}
+
+func (lq *LogQueue) NewQueue() ds.NewQueueFunc {
+	return func() ds.Queue {
+		return ds.NewTimedPriorityQueue(lq.round)
+	}
+}
+
+func (lq *LogQueue) Len() int {
+	lq.mu.Lock()
+	defer lq.mu.Unlock()
+	return lq.queue.Len()
+}
+
+func (lq *LogQueue) IsEmpty() bool {
+	lq.mu.Lock()
+	defer lq.mu.Unlock()
+	return lq.queue.IsEmpty()
+}
+
+// Push appends the event to the log before it can be pulled.
+// A popped item is pushed back without appending it again.
+func (lq *LogQueue) Push(v interface{}) {
+	lq.mu.Lock()
+	defer lq.mu.Unlock()
+	item := v.(*ds.Item)
+	if _, ok := item.Value().(logRecord); ok {
+		lq.queue.Push(item)
+		return
+	}
+	e := item.Value().(Event)
+	data, err := json.Marshal(e)
+	if err != nil {
+		fmt.Printf("failed to encode: %v (%v)\n", e, err)
+		return
+	}
+	offset, err := lq.log.Append(data)
+	if err != nil {
+		fmt.Printf("failed to append: %v (%v)\n", e, err)
+		return
+	}
+	lq.queue.Push(ds.NewItem(e.Round, logRecord{offset: offset, event: e}))
+}
+
+// Pop returns ErrEmptyQueue if no event is ready at the current round.
+// The offset is not committed until the popped item is acknowledged.
+func (lq *LogQueue) Pop() interface{} {
+	lq.mu.Lock()
+	defer lq.mu.Unlock()
+	if lq.queue.IsEmpty() {
+		return ErrEmptyQueue
+	}
+	return lq.queue.Pop()
+}
+
+// Ack moves the committed offset over the contiguous acknowledged records
+func (lq *LogQueue) Ack(item *ds.Item) {
+	lq.mu.Lock()
+	defer lq.mu.Unlock()
+	offset := item.Value().(logRecord).offset
+	lq.acked[offset] = true
+	committed := lq.log.Offset(lq.consumer)
+	next := committed
+	for lq.acked[next] {
+		delete(lq.acked, next)
+		next++
+	}
+	if next == committed {
+		return
+	}
+	if err := lq.log.Commit(lq.consumer, next); err != nil {
+		fmt.Printf("failed to commit offset: %s %d (%v)\n", lq.consumer, next, err)
+	}
+}
+
+// Crash drops the events kept in memory, the log is left untouched
+func (lq *LogQueue) Crash() {
+	lq.mu.Lock()
+	defer lq.mu.Unlock()
+	lq.reset()
+}
+
+func (lq *LogQueue) reset() {
+	lq.queue = ds.NewTimedPriorityQueue(lq.round)
+	lq.acked = map[int]bool{}
+}
+
+// Recover replays the events after the committed offset.
+// The events pulled but not committed before the crash are delivered again.
+func (lq *LogQueue) Recover() error {
+	lq.mu.Lock()
+	defer lq.mu.Unlock()
+	lq.reset()
+	for offset := lq.log.Offset(lq.consumer); offset < lq.log.End(); offset++ {
+		data, err := lq.log.Read(offset)
+		if err != nil {
+			return err
+		}
+		e := Event{}
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		lq.queue.Push(ds.NewItem(e.Round, logRecord{offset: offset, event: e}))
+	}
+	return nil
+}
+
+func (lq *LogQueue) Close() error {
+	return lq.log.Close()
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// the distributions of the latency of a link
+const (
+	LatencyFixed       = "fixed"
+	LatencyUniform     = "uniform"
+	LatencyExponential = "exponential"
+)
+
+// DefaultReorderWindow is the number of rounds a held event waits for a later event to overtake it
+const DefaultReorderWindow = 3
+
+// Latency is the distribution of the extra rounds an event spends on a link.
+// A fixed latency takes Rounds, a uniform latency takes Min to Max rounds,
+// and an exponential latency takes Mean rounds on average.
+type Latency struct {
+	Dist   string  `json:"dist"`
+	Rounds int     `json:"rounds,omitempty"`
+	Min    int     `json:"min,omitempty"`
+	Max    int     `json:"max,omitempty"`
+	Mean   float64 `json:"mean,omitempty"`
+}
+
+func (l Latency) validate() error {
+	switch l.Dist {
+	case "":
+	case LatencyFixed:
+		if l.Rounds < 0 {
+			return fmt.Errorf("negative latency %d", l.Rounds)
+		}
+	case LatencyUniform:
+		if l.Min < 0 || l.Max < l.Min {
+			return fmt.Errorf("latency range [%d, %d] out of order", l.Min, l.Max)
+		}
+	case LatencyExponential:
+		if l.Mean < 0 {
+			return fmt.Errorf("negative mean latency %v", l.Mean)
+		}
+	default:
+		return fmt.Errorf("unknown latency distribution %q", l.Dist)
+	}
+	return nil
+}
+
+// LinkProfile describes how a link delays, drops and reorders the events
+type LinkProfile struct {
+	Latency Latency `json:"latency"`
+	// the probability that an event is lost without the sender noticing it
+	DropRate float64 `json:"drop_rate,omitempty"`
+	// the probability that an event is held until the next event on the link overtakes it
+	ReorderRate float64 `json:"reorder_rate,omitempty"`
+}
+
+func (p LinkProfile) Validate() error {
+	if err := p.Latency.validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidLinkProfile, err)
+	}
+	if p.DropRate < 0 || p.DropRate > 1 {
+		return fmt.Errorf("%w: drop rate %v out of range", ErrInvalidLinkProfile, p.DropRate)
+	}
+	if p.ReorderRate < 0 || p.ReorderRate > 1 {
+		return fmt.Errorf("%w: reorder rate %v out of range", ErrInvalidLinkProfile, p.ReorderRate)
+	}
+	return nil
+}
+
+// LinkConfig is the profile of a single link
+type LinkConfig struct {
+	Link
+	LinkProfile
+}
+
+// SetLinkProfile sets the profile of the link from one component to another
+func (sys *System) SetLinkProfile(from, to string, profile LinkProfile) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	sys.Cfg.linkMu.Lock()
+	defer sys.Cfg.linkMu.Unlock()
+	sys.Cfg.profiles[Link{From: from, To: to}] = profile
+	return nil
+}
+
+// SetDefaultLinkProfile sets the profile of the links without their own profile
+func (sys *System) SetDefaultLinkProfile(profile LinkProfile) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	sys.Cfg.linkMu.Lock()
+	defer sys.Cfg.linkMu.Unlock()
+	sys.Cfg.defaultProfile = profile
+	return nil
+}
+
+func (sys *System) LinkProfile(from, to string) LinkProfile {
+	sys.Cfg.linkMu.Lock()
+	defer sys.Cfg.linkMu.Unlock()
+	if profile, ok := sys.Cfg.profiles[Link{From: from, To: to}]; ok {
+		return profile
+	}
+	return sys.Cfg.defaultProfile
+}
+
+// Delay samples the extra rounds of the latency.
+// A fixed latency does not draw from the random source, so it keeps the simulation unchanged otherwise.
+func (sys *System) Delay(l Latency) int {
+	switch l.Dist {
+	case LatencyFixed:
+		return l.Rounds
+	case LatencyUniform:
+		if l.Max <= l.Min {
+			return l.Min
+		}
+		sys.Cfg.randMu.Lock()
+		defer sys.Cfg.randMu.Unlock()
+		return l.Min + sys.Cfg.rand.Intn(l.Max-l.Min+1)
+	case LatencyExponential:
+		if l.Mean <= 0 {
+			return 0
+		}
+		sys.Cfg.randMu.Lock()
+		defer sys.Cfg.randMu.Unlock()
+		return int(math.Round(sys.Cfg.rand.ExpFloat64() * l.Mean))
+	}
+	return 0
+}
+
+// held is an event kept back on its link so that the next event overtakes it
+type held struct {
+	event    Event
+	deadline int
+}
+
+// hold keeps the event back until the next event on the link or the end of the reorder window
+func (eq *EventQueue) hold(link Link, e Event) {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	eq.held[link] = &held{event: e, deadline: eq.sys.Round() + DefaultReorderWindow}
+}
+
+func (eq *EventQueue) isHolding(link Link) bool {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	_, ok := eq.held[link]
+	return ok
+}
+
+// release delivers the held event of the link after the event arriving at the round
+func (eq *EventQueue) release(link Link, round int) {
+	eq.mu.Lock()
+	h, ok := eq.held[link]
+	delete(eq.held, link)
+	eq.mu.Unlock()
+	if !ok {
+		return
+	}
+	e := h.event
+	if e.Round <= round {
+		e.Round = round + 1
+	}
+	eq.push(e)
+}
+
+// releaseExpired delivers the held events to the receiver whose reorder window has passed,
+// so that they arrive even if their sender has crashed
+func (eq *EventQueue) releaseExpired(srv string) {
+	eq.mu.Lock()
+	links := []Link{}
+	for link, h := range eq.held {
+		if link.To == srv && h.deadline <= eq.sys.Round() {
+			links = append(links, link)
+		}
+	}
+	eq.mu.Unlock()
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].From < links[j].From
+	})
+	for _, link := range links {
+		eq.release(link, 0)
+	}
+}
+
+// Held returns the number of events kept back on the links
+func (eq *EventQueue) Held() int {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	return len(eq.held)
+}
+
+// drop loses the event on its link or with the crashed event queue,
+// the transaction is left to expire in the tx manager
+func (eq *EventQueue) drop(e Event) {
+	eq.mu.Lock()
+	eq.dropped = append(eq.dropped, e)
+	eq.mu.Unlock()
+	eq.sys.Report().AddDropped(eq.sys.Round(), e)
+}
+
+// Dropped returns the events lost on the links
+func (eq *EventQueue) Dropped() []Event {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	dropped := make([]Event, len(eq.dropped))
+	copy(dropped, eq.dropped)
+	return dropped
+}
@@ -9,7 +9,10 @@ type NotificationService struct {
 }
 
 func NewNotificationService(sys *System) *NotificationService {
+	store := NewMemoryStore()
+	sys.RegisterStore(ServiceNotification, store)
 	dispatcher := NewEventDispatcher(sys.EventQueue, ServiceNotification)
+	dispatcher.SetStore(store)
 
 	dispatcher.Focus("notification").
 		Add(func(e Event) (Event, error) {
@@ -28,12 +31,5 @@ func (ns *NotificationService) Name() string {
 }
 
 func (ns *NotificationService) Receive() {
-	eq := ns.sys.EventQueue
-	for {
-		e, err := eq.Pull(ServiceNotification)
-		if err != nil {
-			break
-		}
-		ns.dispatcher.Dispatch(e)
-	}
+	ns.sys.EventQueue.Consume(ServiceNotification, ns.dispatcher.Dispatch)
 }
@@ -11,14 +11,28 @@ type OrderService struct {
 }
 
 func NewOrderService(sys *System) *OrderService {
+	store := NewMemoryStore()
+	sys.RegisterStore(ServiceOrder, store)
 	dispatcher := NewEventDispatcher(sys.EventQueue, ServiceOrder)
+	dispatcher.SetStore(store)
 
 	dispatcher.Focus("order").
-		Add(func(e Event) (Event, error) {
+		AddTxWithCompensation(func(tx StoreTx, e Event) (Event, error) {
+			if orderID, ok := e.Get("OrderID"); ok {
+				if err := tx.Put(orderID.(string), "created"); err != nil {
+					return e, err
+				}
+			}
 			e.To = ServiceShipping
 			e.Endpoint = "shipping"
 			e.Stage = 0
 			return e, nil
+		}, func(tx StoreTx, e Event) (Event, error) {
+			if orderID, ok := e.Get("OrderID"); ok {
+				tx.Restore(orderID.(string))
+			}
+			e.Set("OrderStatus", "cancelled")
+			return e, nil
 		}).
 		Add(func(e Event) (Event, error) {
 			e.To = ServiceCustomer
@@ -42,12 +56,5 @@ func (ods *OrderService) Name() string {
 }
 
 func (ods *OrderService) Receive() {
-	eq := ods.sys.EventQueue
-	for {
-		e, err := eq.Pull(ServiceOrder)
-		if err != nil {
-			break
-		}
-		ods.dispatcher.Dispatch(e)
-	}
+	ods.sys.EventQueue.Consume(ServiceOrder, ods.dispatcher.Dispatch)
 }
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+)
+
+// OutboxKey identifies an event processed by a stage.
+// The duplicate events share the same tag while the different events in the same stage rarely collide.
+type OutboxKey struct {
+	TxID     string
+	Endpoint string
+	Stage    int
+	Tag      int
+}
+
+func NewOutboxKey(e Event) OutboxKey {
+	return OutboxKey{
+		TxID:     e.TxID,
+		Endpoint: e.Endpoint,
+		Stage:    e.Stage,
+		Tag:      e.Tag,
+	}
+}
+
+func (k OutboxKey) String() string {
+	return fmt.Sprintf("%s|%s|%d|%d", k.TxID, k.Endpoint, k.Stage, k.Tag)
+}
+
+type OutboxEntry struct {
+	Key   OutboxKey
+	Round int
+	// the event emitted after processing
+	Event Event
+	// the events emitted by the tx manager, which may send several at once
+	Events []Event `json:",omitempty"`
+}
+
+type Outbox interface {
+	// Insert returns false if the key already exists
+	Insert(OutboxEntry) bool
+	Get(OutboxKey) (OutboxEntry, bool)
+	Len() int
+	// Clear drops the entries, the tx manager rebuilds them from its journal
+	Clear()
+}
+
+type MemoryOutbox struct {
+	table map[OutboxKey]OutboxEntry
+	mu    sync.Mutex
+}
+
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{
+		table: map[OutboxKey]OutboxEntry{},
+	}
+}
+
+func (mo *MemoryOutbox) Insert(entry OutboxEntry) bool {
+	mo.mu.Lock()
+	defer mo.mu.Unlock()
+	if _, ok := mo.table[entry.Key]; ok {
+		return false
+	}
+	mo.table[entry.Key] = entry
+	return true
+}
+
+func (mo *MemoryOutbox) Get(key OutboxKey) (OutboxEntry, bool) {
+	mo.mu.Lock()
+	defer mo.mu.Unlock()
+	entry, ok := mo.table[key]
+	return entry, ok
+}
+
+func (mo *MemoryOutbox) Clear() {
+	mo.mu.Lock()
+	defer mo.mu.Unlock()
+	mo.table = map[OutboxKey]OutboxEntry{}
+}
+
+func (mo *MemoryOutbox) Len() int {
+	mo.mu.Lock()
+	defer mo.mu.Unlock()
+	return len(mo.table)
+}
@@ -0,0 +1,164 @@
+package service_test
+
+import (
+	"atm/service"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryOutbox(t *testing.T) {
+	outbox := service.NewMemoryOutbox()
+	entry := service.OutboxEntry{
+		Key: service.OutboxKey{
+			TxID:     "tx-1",
+			Endpoint: "order",
+			Stage:    0,
+			Tag:      7,
+		},
+		Round: 3,
+	}
+	assert.True(t, outbox.Insert(entry))
+	assert.False(t, outbox.Insert(entry))
+	assert.Equal(t, 1, outbox.Len())
+
+	got, ok := outbox.Get(entry.Key)
+	assert.True(t, ok)
+	assert.Equal(t, 3, got.Round)
+
+	// the retry of another sender has another tag
+	entry.Key.Tag = 8
+	_, ok = outbox.Get(entry.Key)
+	assert.False(t, ok)
+	assert.True(t, outbox.Insert(entry))
+	assert.Equal(t, 2, outbox.Len())
+}
+
+func newInventoryDispatcher(sys *service.System, calls *int) *service.EventDispatcher {
+	sys.EventQueue.Register("inventory")
+	dispatcher := service.NewEventDispatcher(sys.EventQueue, "inventory")
+	dispatcher.Focus("reserve").Add(func(e service.Event) (service.Event, error) {
+		*calls++
+		return e, nil
+	})
+	return dispatcher
+}
+
+func newReserveEvent() service.Event {
+	e := service.NewEvent()
+	e.TxID = "tx-1"
+	e.From = service.ServiceTxManager
+	e.To = "inventory"
+	e.Endpoint = "reserve"
+	e.Tag = 7
+	return e
+}
+
+func TestDispatchDuplicate(t *testing.T) {
+	sys := service.NewSystem()
+	sys.Report().SetWriter(io.Discard)
+	calls := 0
+	dispatcher := newInventoryDispatcher(sys, &calls)
+
+	e := newReserveEvent()
+	dispatcher.Dispatch(e)
+	dispatcher.Dispatch(e)
+
+	// the duplicate is found in the outbox and the stage runs once
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 1, dispatcher.Outbox().Len())
+	assert.Equal(t, 1, sys.Report().Duplicates()["inventory|reserve|0"])
+}
+
+func TestDispatchWithoutDeduplication(t *testing.T) {
+	sys := service.NewSystem()
+	sys.Report().SetWriter(io.Discard)
+	sys.SetDeduplication(false)
+	calls := 0
+	dispatcher := newInventoryDispatcher(sys, &calls)
+
+	e := newReserveEvent()
+	dispatcher.Dispatch(e)
+	dispatcher.Dispatch(e)
+
+	assert.Equal(t, 2, calls)
+	assert.Zero(t, dispatcher.Outbox().Len())
+}
+
+func newRollbackEvent() service.Event {
+	e := newReserveEvent()
+	e.Phase = service.PhaseRollback
+	e.RemainingRetryTime = service.DefaultRetryTime
+	return e
+}
+
+func TestDispatchCompensationRetry(t *testing.T) {
+	sys := service.NewSystem()
+	sys.Report().SetWriter(io.Discard)
+	calls := 0
+	dispatcher := newInventoryDispatcher(sys, &calls)
+	failures := 2
+	dispatcher.Focus("reserve").Compensate(0, func(e service.Event) (service.Event, error) {
+		if failures > 0 {
+			failures--
+			return e, service.ErrStageFailed
+		}
+		return e, nil
+	})
+
+	// the failed compensation is retried with backoff until it succeeds
+	dispatcher.Dispatch(newRollbackEvent())
+	for i := 0; i < 20; i++ {
+		sys.Advance()
+		sys.EventQueue.Consume("inventory", dispatcher.Dispatch)
+	}
+	assert.Zero(t, failures)
+	assert.Equal(t, 1, dispatcher.Outbox().Len())
+	assert.Empty(t, sys.EventQueue.DeadLetters())
+
+	e, err := sys.EventQueue.Pull(service.ServiceTxManager)
+	assert.Nil(t, err)
+	assert.Equal(t, service.PhaseRollback, e.Phase)
+	assert.Equal(t, "inventory", e.From)
+}
+
+func TestDispatchCompensationDeadLetter(t *testing.T) {
+	sys := service.NewSystem()
+	sys.Report().SetWriter(io.Discard)
+	calls := 0
+	dispatcher := newInventoryDispatcher(sys, &calls)
+	dispatcher.Focus("reserve").Compensate(0, func(e service.Event) (service.Event, error) {
+		return e, service.ErrStageFailed
+	})
+
+	// the compensation which never succeeds is escalated once its retries run out
+	dispatcher.Dispatch(newRollbackEvent())
+	for i := 0; i < 200; i++ {
+		sys.Advance()
+		sys.EventQueue.Consume("inventory", dispatcher.Dispatch)
+	}
+	assert.Zero(t, dispatcher.Outbox().Len())
+	deadLetters := sys.EventQueue.DeadLetters()
+	assert.Equal(t, 1, len(deadLetters))
+	assert.Equal(t, service.ErrStageFailed, deadLetters[0].Cause)
+}
+
+func TestDispatchUnknownError(t *testing.T) {
+	sys := service.NewSystem()
+	sys.Report().SetWriter(io.Discard)
+	sys.EventQueue.Register("inventory")
+	dispatcher := service.NewEventDispatcher(sys.EventQueue, "inventory")
+	failure := errors.New("out of stock")
+	dispatcher.Focus("reserve").Add(func(e service.Event) (service.Event, error) {
+		return e, failure
+	})
+
+	// the event is dead-lettered instead of being acknowledged and lost
+	dispatcher.Dispatch(newReserveEvent())
+	assert.Zero(t, dispatcher.Outbox().Len())
+	deadLetters := sys.EventQueue.DeadLetters()
+	assert.Equal(t, 1, len(deadLetters))
+	assert.Equal(t, failure, deadLetters[0].Cause)
+}
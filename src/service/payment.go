@@ -9,7 +9,10 @@ type PaymentService struct {
 }
 
 func NewPaymentService(sys *System) *PaymentService {
+	store := NewMemoryStore()
+	sys.RegisterStore(ServicePayment, store)
 	dispatcher := NewEventDispatcher(sys.EventQueue, ServicePayment)
+	dispatcher.SetStore(store)
 
 	dispatcher.Focus("payment_control").
 		Add(func(e Event) (Event, error) {
@@ -19,6 +22,10 @@ func NewPaymentService(sys *System) *PaymentService {
 			return e, nil
 		}).
 		Add(func(e Event) (Event, error) {
+			if abort, ok := e.Get("Abort"); ok && abort == true {
+				e.Abort()
+				return e, nil
+			}
 			e.Commit()
 			return e, nil
 		}).
@@ -40,7 +47,13 @@ func NewPaymentService(sys *System) *PaymentService {
 			e.Stage = 0
 			return e, nil
 		}).
-		Add(func(e Event) (Event, error) {
+		AddTx(func(tx StoreTx, e Event) (Event, error) {
+			// the payment is recorded after the transaction commits
+			if orderID, ok := e.Get("OrderID"); ok {
+				if err := tx.Put(orderID.(string), "paid"); err != nil {
+					return e, err
+				}
+			}
 			return e, nil
 		})
 	return &PaymentService{
@@ -55,12 +68,5 @@ func (ps *PaymentService) Name() string {
 }
 
 func (ps *PaymentService) Receive() {
-	eq := ps.sys.EventQueue
-	for {
-		e, err := eq.Pull(ServicePayment)
-		if err != nil {
-			break
-		}
-		ps.dispatcher.Dispatch(e)
-	}
+	ps.sys.EventQueue.Consume(ServicePayment, ps.dispatcher.Dispatch)
 }
@@ -0,0 +1,628 @@
+package service
+
+import (
+	"atm/ds"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// the messages between the replicas of the tx manager
+const (
+	RaftVote        = "vote"
+	RaftVoteReply   = "vote_reply"
+	RaftAppend      = "append"
+	RaftAppendReply = "append_reply"
+)
+
+const (
+	// the endpoint of the messages between the replicas
+	EndpointRaft = "raft"
+	// a follower without a leader starts an election after
+	// DefaultElectionTimeout to 2*DefaultElectionTimeout-1 rounds
+	DefaultElectionTimeout = 4
+)
+
+type RaftRole int
+
+const (
+	RoleFollower RaftRole = iota
+	RoleCandidate
+	RoleLeader
+)
+
+func (r RaftRole) String() string {
+	switch r {
+	case RoleFollower:
+		return "follower"
+	case RoleCandidate:
+		return "candidate"
+	case RoleLeader:
+		return "leader"
+	}
+	return fmt.Sprintf("RaftRole(%d)", int(r))
+}
+
+// RaftEntry is a journal record of the tx manager replicated in the term of its leader.
+// An entry without data is appended by a new leader to commit the entries of the previous terms.
+type RaftEntry struct {
+	Term int             `json:"term"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// RaftMessage is carried in the body of an event between the replicas
+type RaftMessage struct {
+	Type string `json:"type"`
+	Term int    `json:"term"`
+	// the last entry of the candidate
+	LastIndex int  `json:"last_index,omitempty"`
+	LastTerm  int  `json:"last_term,omitempty"`
+	Granted   bool `json:"granted,omitempty"`
+	// the entries after the previous entry of the leader, and its commit index
+	PrevIndex int         `json:"prev_index,omitempty"`
+	PrevTerm  int         `json:"prev_term,omitempty"`
+	Entries   []RaftEntry `json:"entries,omitempty"`
+	Commit    int         `json:"commit,omitempty"`
+	Success   bool        `json:"success,omitempty"`
+	// the last index the follower shares with the leader
+	Match int `json:"match,omitempty"`
+}
+
+// ReplicatedTxManager runs the tx manager as a group of replicas.
+// The leader handles the events of the tx manager and replicates its journal to the followers,
+// so the transactions survive as long as a majority of the replicas is alive.
+type ReplicatedTxManager struct {
+	sys   *System
+	nodes []*RaftNode
+	// the last elected leader, it answers the queries when there is no leader
+	last *RaftNode
+}
+
+// NewReplicatedTxManager creates a replica for each instance of the tx manager.
+// The group starts with the first replica as the leader of term 1, as if it was elected before the simulation.
+func NewReplicatedTxManager(sys *System) *ReplicatedTxManager {
+	group := &ReplicatedTxManager{
+		sys:   sys,
+		nodes: []*RaftNode{},
+	}
+	for _, name := range sys.Instances(ServiceTxManager) {
+		group.nodes = append(group.nodes, newRaftNode(sys, group, name))
+	}
+	for _, node := range group.nodes {
+		node.term = 1
+		node.votedFor = group.nodes[0].name
+		node.follow(group.nodes[0].name)
+	}
+	group.nodes[0].lead()
+	return group
+}
+
+func (group *ReplicatedTxManager) Name() string {
+	return ServiceTxManager
+}
+
+// Receive visits the replicas in order
+func (group *ReplicatedTxManager) Receive() {
+	for _, node := range group.nodes {
+		node.Receive()
+	}
+}
+
+func (group *ReplicatedTxManager) Nodes() []*RaftNode {
+	return append([]*RaftNode{}, group.nodes...)
+}
+
+// Leader returns the live leader of the latest term, nil if there is none
+func (group *ReplicatedTxManager) Leader() *RaftNode {
+	var leader *RaftNode
+	for _, node := range group.nodes {
+		if node.crashed || node.role != RoleLeader {
+			continue
+		}
+		if leader == nil || node.term > leader.term {
+			leader = node
+		}
+	}
+	return leader
+}
+
+// TxManager returns the state of the leader, or of the last leader if there is none
+func (group *ReplicatedTxManager) TxManager() *TxManager {
+	if leader := group.Leader(); leader != nil {
+		return leader.tm
+	}
+	if group.last != nil {
+		return group.last.tm
+	}
+	return group.nodes[0].tm
+}
+
+func (group *ReplicatedTxManager) majority() int {
+	return len(group.nodes)/2 + 1
+}
+
+type pendingEvent struct {
+	index int
+	event Event
+}
+
+// RaftNode is a replica of the tx manager
+type RaftNode struct {
+	sys   *System
+	group *ReplicatedTxManager
+	name  string
+	// the state machine rebuilt from the log when the replica becomes the leader
+	tm *TxManager
+	// the persistent state survives the crash of the replica
+	term     int
+	votedFor string
+	log      []RaftEntry
+	// the volatile state is lost with the crash
+	role       RaftRole
+	leader     string
+	commit     int
+	votes      map[string]bool
+	nextIndex  map[string]int
+	matchIndex map[string]int
+	deadline   int
+	// the events handled by the leader, acknowledged once their records are committed
+	pending map[OutboxKey]pendingEvent
+	// the events emitted by the leader, sent once their records are committed
+	outgoing []pendingEvent
+	crashed  bool
+}
+
+func newRaftNode(sys *System, group *ReplicatedTxManager, name string) *RaftNode {
+	node := &RaftNode{
+		sys:     sys,
+		group:   group,
+		name:    name,
+		tm:      NewTxManager(sys),
+		log:     []RaftEntry{},
+		pending: map[OutboxKey]pendingEvent{},
+	}
+	node.tm.SetJournal(&raftJournal{node: node, offsets: map[string]int{}})
+	node.tm.hold = func(e Event) {
+		node.outgoing = append(node.outgoing, pendingEvent{index: len(node.log), event: e})
+	}
+	sys.EventQueue.Register(name)
+	return node
+}
+
+func (node *RaftNode) Name() string {
+	return node.name
+}
+
+func (node *RaftNode) Role() RaftRole {
+	return node.role
+}
+
+func (node *RaftNode) Term() int {
+	return node.term
+}
+
+// Commit returns the number of entries known to be replicated on a majority
+func (node *RaftNode) Commit() int {
+	return node.commit
+}
+
+func (node *RaftNode) Len() int {
+	return len(node.log)
+}
+
+func (node *RaftNode) TxManager() *TxManager {
+	return node.tm
+}
+
+func (node *RaftNode) isCrashed() bool {
+	return node.sys.IsCrashed(ServiceTxManager) || node.sys.IsCrashed(node.name)
+}
+
+func (node *RaftNode) Receive() {
+	if node.isCrashed() {
+		if !node.crashed {
+			node.crash()
+		}
+		return
+	}
+	if node.crashed {
+		node.crashed = false
+		node.resetDeadline()
+	}
+
+	eq := node.sys.EventQueue
+	for {
+		e, err := eq.Pull(node.name)
+		if err != nil {
+			break
+		}
+		eq.Ack(node.name, e)
+		if m, ok := raftMessageOf(e); ok {
+			node.step(e.From, m)
+		}
+	}
+	if node.role != RoleLeader && node.sys.Round() >= node.deadline {
+		node.campaign()
+	}
+	if node.role == RoleLeader {
+		node.serve()
+		node.replicate()
+		node.advance()
+	}
+}
+
+// crash keeps the term, the vote and the log
+func (node *RaftNode) crash() {
+	node.crashed = true
+	node.role = RoleFollower
+	node.leader = ""
+	node.commit = 0
+	node.votes = nil
+	node.pending = map[OutboxKey]pendingEvent{}
+	node.outgoing = nil
+	node.tm.Crash()
+}
+
+func (node *RaftNode) resetDeadline() {
+	node.deadline = node.sys.Round() + node.sys.Delay(Latency{
+		Dist: LatencyUniform,
+		Min:  DefaultElectionTimeout,
+		Max:  2*DefaultElectionTimeout - 1,
+	})
+}
+
+func (node *RaftNode) lastTerm() int {
+	if len(node.log) == 0 {
+		return 0
+	}
+	return node.log[len(node.log)-1].Term
+}
+
+func (node *RaftNode) termAt(index int) int {
+	if index <= 0 || index > len(node.log) {
+		return 0
+	}
+	return node.log[index-1].Term
+}
+
+func (node *RaftNode) peers() []string {
+	peers := []string{}
+	for _, other := range node.group.nodes {
+		if other != node {
+			peers = append(peers, other.name)
+		}
+	}
+	return peers
+}
+
+// send delivers the message once, the lost messages are sent again in the next rounds
+func (node *RaftNode) send(to string, m RaftMessage) {
+	e := NewEvent()
+	e.From = node.name
+	e.To = to
+	e.Endpoint = EndpointRaft
+	e.Round = node.sys.Round() + 1
+	e.Set(EndpointRaft, m)
+	node.sys.EventQueue.SendOnce(e)
+}
+
+// raftMessageOf reads the message in the body of the event
+func raftMessageOf(e Event) (RaftMessage, bool) {
+	v, ok := e.Get(EndpointRaft)
+	if !ok {
+		return RaftMessage{}, false
+	}
+	if m, ok := v.(RaftMessage); ok {
+		return m, true
+	}
+	// the body read back from a durable queue is decoded as a map
+	m := RaftMessage{}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return m, false
+	}
+	return m, json.Unmarshal(data, &m) == nil
+}
+
+func (node *RaftNode) step(from string, m RaftMessage) {
+	if m.Term > node.term {
+		node.term = m.Term
+		node.votedFor = ""
+		node.follow("")
+	}
+	switch m.Type {
+	case RaftVote:
+		// the candidate must hold every entry the replica has
+		upToDate := m.LastTerm > node.lastTerm() || (m.LastTerm == node.lastTerm() && m.LastIndex >= len(node.log))
+		granted := m.Term == node.term && (node.votedFor == "" || node.votedFor == from) && upToDate
+		if granted {
+			node.votedFor = from
+			node.resetDeadline()
+		}
+		node.send(from, RaftMessage{Type: RaftVoteReply, Term: node.term, Granted: granted})
+
+	case RaftVoteReply:
+		if node.role != RoleCandidate || m.Term != node.term || !m.Granted {
+			return
+		}
+		node.votes[from] = true
+		if len(node.votes) >= node.group.majority() {
+			node.lead()
+		}
+
+	case RaftAppend:
+		if m.Term < node.term {
+			node.send(from, RaftMessage{Type: RaftAppendReply, Term: node.term})
+			return
+		}
+		node.follow(from)
+		if m.PrevIndex > len(node.log) || node.termAt(m.PrevIndex) != m.PrevTerm {
+			node.send(from, RaftMessage{Type: RaftAppendReply, Term: node.term})
+			return
+		}
+		for i, entry := range m.Entries {
+			index := m.PrevIndex + i + 1
+			if index <= len(node.log) {
+				if node.log[index-1].Term == entry.Term {
+					continue
+				}
+				// the entries of a deposed leader are replaced
+				node.truncate(index - 1)
+			}
+			node.log = append(node.log, entry)
+		}
+		match := m.PrevIndex + len(m.Entries)
+		if m.Commit > node.commit {
+			node.commit = m.Commit
+			if node.commit > match {
+				node.commit = match
+			}
+		}
+		node.send(from, RaftMessage{Type: RaftAppendReply, Term: node.term, Success: true, Match: match})
+
+	case RaftAppendReply:
+		if node.role != RoleLeader || m.Term != node.term {
+			return
+		}
+		if !m.Success {
+			if node.nextIndex[from] > 1 {
+				node.nextIndex[from]--
+			}
+			return
+		}
+		if m.Match > node.matchIndex[from] {
+			node.matchIndex[from] = m.Match
+		}
+		node.nextIndex[from] = node.matchIndex[from] + 1
+		node.advance()
+	}
+}
+
+// truncate drops the entries from the index, a snapshot among them cannot be replayed any more
+func (node *RaftNode) truncate(index int) {
+	node.log = node.log[:index]
+	journal := node.tm.Journal().(*raftJournal)
+	for consumer, offset := range journal.offsets {
+		if offset > index {
+			journal.offsets[consumer] = 0
+		}
+	}
+}
+
+// follow steps down to a follower of the leader, an empty leader is unknown
+func (node *RaftNode) follow(leader string) {
+	node.role = RoleFollower
+	node.leader = leader
+	// the next leader handles the events again
+	node.pending = map[OutboxKey]pendingEvent{}
+	node.outgoing = nil
+	node.resetDeadline()
+}
+
+func (node *RaftNode) campaign() {
+	node.term++
+	node.role = RoleCandidate
+	node.leader = ""
+	node.votedFor = node.name
+	node.votes = map[string]bool{node.name: true}
+	node.resetDeadline()
+	if len(node.votes) >= node.group.majority() {
+		node.lead()
+		return
+	}
+	for _, peer := range node.peers() {
+		node.send(peer, RaftMessage{
+			Type:      RaftVote,
+			Term:      node.term,
+			LastIndex: len(node.log),
+			LastTerm:  node.lastTerm(),
+		})
+	}
+}
+
+// lead rebuilds the transactions from the log and appends an empty entry of the new term
+func (node *RaftNode) lead() {
+	node.role = RoleLeader
+	node.leader = node.name
+	node.nextIndex = map[string]int{}
+	node.matchIndex = map[string]int{}
+	for _, peer := range node.peers() {
+		node.nextIndex[peer] = len(node.log) + 1
+		node.matchIndex[peer] = 0
+	}
+	node.pending = map[OutboxKey]pendingEvent{}
+	node.outgoing = nil
+	node.log = append(node.log, RaftEntry{Term: node.term})
+	if err := node.tm.Restart(); err != nil {
+		fmt.Printf("failed to restart: %s (%v)\n", node.name, err)
+	}
+	node.group.last = node
+}
+
+// serve handles the events of the tx manager.
+// An event is acknowledged after the records it produced are committed,
+// otherwise its lease expires and the next leader handles it again.
+func (node *RaftNode) serve() {
+	eq := node.sys.EventQueue
+	eq.Flush(ServiceTxManager)
+	for {
+		e, err := eq.Pull(ServiceTxManager)
+		if err != nil {
+			break
+		}
+		key := NewOutboxKey(e)
+		if p, ok := node.pending[key]; ok {
+			// redelivered before the commit, wait with the new lease
+			node.pending[key] = pendingEvent{index: p.index, event: e}
+			continue
+		}
+		end := len(node.log)
+		if err := node.tm.handle(e); err != nil {
+			continue
+		}
+		if len(node.log) == end {
+			eq.Ack(ServiceTxManager, e)
+			continue
+		}
+		node.pending[key] = pendingEvent{index: len(node.log), event: e}
+	}
+	node.tm.expire()
+}
+
+func (node *RaftNode) replicate() {
+	for _, peer := range node.peers() {
+		next := node.nextIndex[peer]
+		node.send(peer, RaftMessage{
+			Type:      RaftAppend,
+			Term:      node.term,
+			PrevIndex: next - 1,
+			PrevTerm:  node.termAt(next - 1),
+			Entries:   append([]RaftEntry{}, node.log[next-1:]...),
+			Commit:    node.commit,
+		})
+	}
+}
+
+// advance commits the latest entry of the current term stored on a majority,
+// then sends the events emitted by the committed records and acknowledges the events which produced them
+func (node *RaftNode) advance() {
+	for index := len(node.log); index > node.commit; index-- {
+		if node.log[index-1].Term != node.term {
+			break
+		}
+		n := 1
+		for _, match := range node.matchIndex {
+			if match >= index {
+				n++
+			}
+		}
+		if n >= node.group.majority() {
+			node.commit = index
+			break
+		}
+	}
+
+	keys := []OutboxKey{}
+	for key, p := range node.pending {
+		if p.index <= node.commit {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return node.pending[keys[i]].index < node.pending[keys[j]].index
+	})
+	outgoing := []pendingEvent{}
+	for _, p := range node.outgoing {
+		if p.index > node.commit {
+			outgoing = append(outgoing, p)
+			continue
+		}
+		if err := node.sys.EventQueue.Send(p.event); err != nil {
+			fmt.Printf("failed to send: %v (%v)\n", p.event, err)
+		}
+	}
+	node.outgoing = outgoing
+	for _, key := range keys {
+		node.sys.EventQueue.Ack(ServiceTxManager, node.pending[key].event)
+		delete(node.pending, key)
+	}
+}
+
+// Committed rebuilds the transactions from the committed entries of the log
+func (node *RaftNode) Committed() ([]TxStatus, error) {
+	journal := ds.NewMemoryLog()
+	for _, entry := range node.log[:node.commit] {
+		if _, err := journal.Append(entry.Data); err != nil {
+			return nil, err
+		}
+	}
+	tm := NewTxManager(node.sys)
+	if err := tm.SetJournal(journal); err != nil {
+		return nil, err
+	}
+	return tm.Statuses(), nil
+}
+
+// raftJournal is the journal of the tx manager of a replica, only the leader appends to it
+type raftJournal struct {
+	node    *RaftNode
+	offsets map[string]int
+}
+
+func (rj *raftJournal) Append(data []byte) (int, error) {
+	node := rj.node
+	if node.role != RoleLeader {
+		return 0, ErrNotLeader
+	}
+	node.log = append(node.log, RaftEntry{Term: node.term, Data: append([]byte{}, data...)})
+	return len(node.log) - 1, nil
+}
+
+func (rj *raftJournal) Read(offset int) ([]byte, error) {
+	if offset < 0 || offset >= len(rj.node.log) {
+		return nil, ds.ErrOffsetOutOfRange
+	}
+	return rj.node.log[offset].Data, nil
+}
+
+func (rj *raftJournal) End() int {
+	return len(rj.node.log)
+}
+
+func (rj *raftJournal) Commit(consumer string, offset int) error {
+	rj.offsets[consumer] = offset
+	return nil
+}
+
+func (rj *raftJournal) Offset(consumer string) int {
+	return rj.offsets[consumer]
+}
+
+func (rj *raftJournal) Close() error {
+	return nil
+}
+
+// SetTxManagerReplicas runs the tx manager as a group of n replicas, which tolerates the crash of a minority.
+// Each replica is an instance of the tx manager, and a single replica keeps the plain tx manager.
+func (sys *System) SetTxManagerReplicas(n int) error {
+	if n <= 1 {
+		return nil
+	}
+	if n%2 == 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidReplicas, n)
+	}
+	sys.SetInstances(ServiceTxManager, n)
+	sys.Register(NewReplicatedTxManager(sys))
+	return nil
+}
+
+// TxManagerAvailable reports whether the tx manager can handle the events in the round
+func (sys *System) TxManagerAvailable() bool {
+	switch tm := sys.Services[ServiceTxManager].(type) {
+	case *TxManager:
+		return !sys.IsCrashed(ServiceTxManager)
+	case *ReplicatedTxManager:
+		return tm.Leader() != nil
+	}
+	return false
+}
@@ -8,16 +8,36 @@ import (
 	"sync"
 )
 
+// stageKey identifies a stage receiving events in a round
+type stageKey struct {
+	round int
+	stage string
+}
+
+// StageCount counts the events delivered to a stage in a round
+type StageCount struct {
+	Round  int
+	Stage  string
+	Events int
+	// the duplicate events suppressed by the outbox
+	Suppressed int
+}
+
 type Report struct {
 	table map[string][]string
-	w     io.Writer
-	mu    sync.Mutex
+	// the number of suppressed duplicate events of each stage
+	duplicates map[string]int
+	stages     map[stageKey]*StageCount
+	w          io.Writer
+	mu         sync.Mutex
 }
 
 func NewReport() *Report {
 	r := Report{
-		table: map[string][]string{},
-		w:     os.Stdout,
+		table:      map[string][]string{},
+		duplicates: map[string]int{},
+		stages:     map[stageKey]*StageCount{},
+		w:          os.Stdout,
 	}
 	return &r
 }
@@ -26,6 +46,22 @@ func (r *Report) SetWriter(w io.Writer) {
 	r.w = w
 }
 
+// Register creates the bucket of the service
+func (r *Report) Register(srvName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.table[srvName]; !ok {
+		r.table[srvName] = []string{}
+	}
+}
+
+// Lines returns the events delivered to the service in order
+func (r *Report) Lines(srvName string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.table[srvName]...)
+}
+
 func (r *Report) Add(srvName string, round int, v interface{}) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -38,8 +74,106 @@ func (r *Report) Add(srvName string, round int, v interface{}) {
 		e.To,
 		e.Endpoint,
 		e.Stage)
-	// r.table[srvName] = append(r.table[srvName], s)
-	fmt.Println(s)
+	if lines, ok := r.table[srvName]; ok {
+		r.table[srvName] = append(lines, s)
+	}
+	// the release of the records is not a stage of the saga
+	if e.Phase != PhaseRelease {
+		r.stage(e).Events++
+	}
+	fmt.Fprintln(r.w, s)
+}
+
+func (r *Report) AddDuplicate(srvName string, round int, v interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := v.(Event)
+	r.duplicates[StageName(srvName, e.Endpoint, e.Stage)]++
+	r.stage(e).Suppressed++
+	s := fmt.Sprintf("[%06d] (%d) TxID: {%s} %s -> [%s/%s/%d] duplicate",
+		round,
+		e.CurrentRetryTime,
+		e.TxID,
+		e.From,
+		e.To,
+		e.Endpoint,
+		e.Stage)
+	fmt.Fprintln(r.w, s)
+}
+
+func (r *Report) AddDeadLetter(round int, e Event, cause error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := fmt.Sprintf("[%06d] (%d) TxID: {%s} %s -> [%s/%s/%d] dead letter (%v)",
+		round,
+		e.CurrentRetryTime,
+		e.TxID,
+		e.From,
+		e.To,
+		e.Endpoint,
+		e.Stage,
+		cause)
+	fmt.Fprintln(r.w, s)
+}
+
+func (r *Report) AddDropped(round int, e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := fmt.Sprintf("[%06d] (%d) TxID: {%s} %s -> [%s/%s/%d] dropped",
+		round,
+		e.CurrentRetryTime,
+		e.TxID,
+		e.From,
+		e.To,
+		e.Endpoint,
+		e.Stage)
+	fmt.Fprintln(r.w, s)
+}
+
+// the events are counted per stage and per delivery round,
+// so the duplicates of a stage are told apart from the later deliveries
+func (r *Report) stage(e Event) *StageCount {
+	key := stageKey{
+		round: e.Round,
+		stage: StageName(e.To, e.Endpoint, e.Stage),
+	}
+	sc, ok := r.stages[key]
+	if !ok {
+		sc = &StageCount{
+			Round: key.round,
+			Stage: key.stage,
+		}
+		r.stages[key] = sc
+	}
+	return sc
+}
+
+// Stages returns the event counts ordered by round and stage
+func (r *Report) Stages() []StageCount {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stages := make([]StageCount, 0, len(r.stages))
+	for _, sc := range r.stages {
+		stages = append(stages, *sc)
+	}
+	sort.Slice(stages, func(i, j int) bool {
+		if stages[i].Round != stages[j].Round {
+			return stages[i].Round < stages[j].Round
+		}
+		return stages[i].Stage < stages[j].Stage
+	})
+	return stages
+}
+
+// Duplicates returns the number of suppressed duplicate events keyed by Service|Endpoint|Stage
+func (r *Report) Duplicates() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	duplicates := map[string]int{}
+	for stage, n := range r.duplicates {
+		duplicates[stage] = n
+	}
+	return duplicates
 }
 
 func (r *Report) Clear(srvName string) {
@@ -65,7 +199,7 @@ func (r *Report) ClearAll() {
 }
 
 func (r *Report) Print(serviceName string) {
-	for s := range r.table {
+	for _, s := range r.table[serviceName] {
 		fmt.Fprintln(r.w, s)
 	}
 }
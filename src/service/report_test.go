@@ -0,0 +1,28 @@
+package service_test
+
+import (
+	"atm/service"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportBucket(t *testing.T) {
+	sys := service.NewSystem()
+	sys.Report().SetWriter(io.Discard)
+	sys.Register(service.NewFakeService())
+
+	e := service.NewEvent()
+	e.TxID = "tx-1"
+	e.From = service.ServiceOrder
+	e.To = "fake"
+	assert.Nil(t, sys.EventQueue.Send(e))
+
+	// the registered service gets a bucket with the events delivered to it
+	lines := sys.Report().Lines("fake")
+	assert.Equal(t, 1, len(lines))
+	assert.Contains(t, lines[0], "TxID: {tx-1} order -> [fake//0]")
+	assert.Empty(t, sys.Report().Lines(service.ServiceShipping))
+	assert.Empty(t, sys.Report().Lines("unknown"))
+}
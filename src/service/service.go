@@ -2,6 +2,7 @@ package service
 
 import (
 	"errors"
+	"fmt"
 )
 
 type Method int
@@ -11,28 +12,53 @@ type Phase int
 type Action int
 type FailureType int
 type MessageType int
+type RollbackMode int
+type ConflictPolicy int
 
 var (
-	ErrUnknown          = errors.New("unknown error")
-	ErrServiceCrash     = errors.New("the service crashed")
-	ErrLinkBroken       = errors.New("the communication link breaks")
-	ErrTimeout          = errors.New("the communication timeout")
-	ErrTTLExpired       = errors.New("ttl has expired")
-	ErrUnrecoverable    = errors.New("unrecoverable error")
-	ErrTooManyRetries   = errors.New("too many retires")
-	ErrNoNmoreService   = errors.New("no more service")
-	ErrWrongMessageType = errors.New("wrong message type")
-	ErrWrongEndpoint    = errors.New("wrong endpoint")
-	ErrWrongStage       = errors.New("wrong stage")
+	ErrUnknown            = errors.New("unknown error")
+	ErrServiceCrash       = errors.New("the service crashed")
+	ErrLinkBroken         = errors.New("the communication link breaks")
+	ErrTimeout            = errors.New("the communication timeout")
+	ErrTTLExpired         = errors.New("ttl has expired")
+	ErrUnrecoverable      = errors.New("unrecoverable error")
+	ErrTooManyRetries     = errors.New("too many retires")
+	ErrNoNmoreService     = errors.New("no more service")
+	ErrWrongMessageType   = errors.New("wrong message type")
+	ErrWrongEndpoint      = errors.New("wrong endpoint")
+	ErrUnknownService     = errors.New("unknown service")
+	ErrStageFailed        = errors.New("the stage failed")
+	ErrInvalidDefinition  = errors.New("invalid saga definition")
+	ErrWrongStage         = errors.New("wrong stage")
+	ErrIllegalTransition  = errors.New("illegal state transition")
+	ErrLocked             = errors.New("the record is locked by another transaction")
+	ErrDuplicateEvent     = errors.New("the event has been processed")
+	ErrTxDone             = errors.New("the local transaction has been committed or rollbacked")
+	ErrLeaseExpired       = errors.New("the lease of the event has expired")
+	ErrInvalidLinkProfile = errors.New("invalid link profile")
+	ErrNotLeader          = errors.New("the replica is not the leader")
+	ErrInvalidReplicas    = errors.New("the number of replicas must be odd")
+	ErrJournal            = errors.New("failed to journal")
 
 	ErrMissingOrderID    = errors.New("missing order id")
 	ErrMissingCusomterID = errors.New("missing customer id")
 
 	ErrEmptyQueue = errors.New("empty queue")
+
+	ErrUnknownFailureType = errors.New("unknown failure type")
 )
 
 const (
 	DefaultRetryTime = 5
+	DefaultSeed      = 42
+	// the rounds a transaction can run before it expires
+	DefaultTTL = 50
+	// the rounds a pulled event stays invisible before it is delivered again
+	DefaultVisibilityTimeout = 3
+	// the records the tx manager journals before it writes a snapshot
+	DefaultJournalCompaction = 256
+	// the times the release of a finished transaction is sent again
+	DefaultReleaseRetryTime = 2
 )
 
 const (
@@ -51,6 +77,8 @@ const (
 	PhaseProcessing
 	PhaseRollback
 	PhaseEnd
+	// the decided transaction releases its pending records in the services
+	PhaseRelease
 )
 
 const (
@@ -59,8 +87,83 @@ const (
 	StateCommit
 	StateAbort
 	StateComplete
+	// the transaction is aborted and all compensations are done
+	StateAborted
 )
 
+func (p Phase) String() string {
+	switch p {
+	case PhaseBegin:
+		return "begin"
+	case PhaseProcessing:
+		return "processing"
+	case PhaseRollback:
+		return "rollback"
+	case PhaseEnd:
+		return "end"
+	case PhaseRelease:
+		return "release"
+	}
+	return "unknown"
+}
+
+var failureTypeNames = map[FailureType]string{
+	FailureNone:           "none",
+	FailureCrash:          "crash",
+	FailureLinkBroken:     "link_broken",
+	FailureCrashAfterPull: "crash_after_pull",
+}
+
+func (ft FailureType) String() string {
+	if name, ok := failureTypeNames[ft]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func ParseFailureType(name string) (FailureType, error) {
+	for ft, n := range failureTypeNames {
+		if n == name {
+			return ft, nil
+		}
+	}
+	return FailureNone, fmt.Errorf("%w: %s", ErrUnknownFailureType, name)
+}
+
+func (ft FailureType) MarshalText() ([]byte, error) {
+	if _, ok := failureTypeNames[ft]; !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownFailureType, ft)
+	}
+	return []byte(ft.String()), nil
+}
+
+func (ft *FailureType) UnmarshalText(text []byte) error {
+	parsed, err := ParseFailureType(string(text))
+	if err != nil {
+		return err
+	}
+	*ft = parsed
+	return nil
+}
+
+func (s State) String() string {
+	switch s {
+	case StateNone:
+		return "none"
+	case StateInProgress:
+		return "in_progress"
+	case StateCommit:
+		return "commit"
+	case StateAbort:
+		return "abort"
+	case StateComplete:
+		return "complete"
+	case StateAborted:
+		return "aborted"
+	}
+	return "unknown"
+}
+
 const (
 	ActionNone Action = iota
 	ActionCheckpoint
@@ -70,6 +173,28 @@ const (
 	FailureNone FailureType = iota
 	FailureCrash
 	FailureLinkBroken
+	// the service crashes after pulling an event and before acknowledging it
+	FailureCrashAfterPull
+)
+
+const (
+	// use the rollback mode of the system
+	RollbackDefault RollbackMode = iota
+	// send all compensations at once
+	RollbackConcurrent
+	// send the next compensation after the previous one is acknowledged
+	RollbackHierarchical
+)
+
+// the outcome when a stage meets a record locked by another transaction
+const (
+	// process the event again in the next round until the deadline of the transaction,
+	// then the expired event aborts the transaction
+	ConflictWait ConflictPolicy = iota
+	// process the event again with exponential backoff until the retry budget runs out
+	ConflictRetry
+	// abort the transaction
+	ConflictAbort
 )
 
 const (
@@ -81,11 +206,45 @@ const (
 	StatusFailed
 )
 
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+func (s Status) MarshalText() ([]byte, error) {
+	if s != StatusOK && s != StatusFailed {
+		return nil, fmt.Errorf("unknown status: %d", s)
+	}
+	return []byte(s.String()), nil
+}
+
+func (s *Status) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "ok":
+		*s = StatusOK
+	case "failed":
+		*s = StatusFailed
+	default:
+		return fmt.Errorf("unknown status: %s", text)
+	}
+	return nil
+}
+
 type Request struct {
-	TxID     string
-	Service  string
-	Endpoint string
-	Body     map[string]interface{}
+	TxID     string `json:"tx_id"`
+	Service  string `json:"service"`
+	Endpoint string `json:"endpoint"`
+	// the retries of the client with the same key start only one transaction
+	IdempotencyKey string `json:"idempotency_key"`
+	// the rounds before the transaction expires, default to DefaultTTL
+	TTL          int                    `json:"ttl"`
+	RollbackMode RollbackMode           `json:"rollback_mode"`
+	Body         map[string]interface{} `json:"body"`
 }
 
 type Service interface {
@@ -11,10 +11,24 @@ type ShippingService struct {
 }
 
 func NewShippingService(sys *System) *ShippingService {
+	store := NewMemoryStore()
+	sys.RegisterStore(ServiceShipping, store)
 	dispatcher := NewEventDispatcher(sys.EventQueue, ServiceShipping)
+	dispatcher.SetStore(store)
 
 	dispatcher.Focus("shipping").
-		Add(func(e Event) (Event, error) {
+		AddTxWithCompensation(func(tx StoreTx, e Event) (Event, error) {
+			if orderID, ok := e.Get("OrderID"); ok {
+				if err := tx.Put(orderID.(string), "scheduled"); err != nil {
+					return e, err
+				}
+			}
+			return e, nil
+		}, func(tx StoreTx, e Event) (Event, error) {
+			if orderID, ok := e.Get("OrderID"); ok {
+				tx.Restore(orderID.(string))
+			}
+			e.Set("ShippingStatus", "cancelled")
 			return e, nil
 		})
 
@@ -30,12 +44,5 @@ func (sps *ShippingService) Name() string {
 }
 
 func (sps *ShippingService) Receive() {
-	eq := sps.sys.EventQueue
-	for {
-		e, err := eq.Pull(ServiceShipping)
-		if err != nil {
-			break
-		}
-		sps.dispatcher.Dispatch(e)
-	}
+	sps.sys.EventQueue.Consume(ServiceShipping, sps.dispatcher.Dispatch)
 }
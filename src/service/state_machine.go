@@ -0,0 +1,50 @@
+package service
+
+// Transition is a state change of a transaction recorded by the tx manager
+type Transition struct {
+	From  State
+	To    State
+	Phase Phase
+	Round int
+}
+
+type StateMachine struct {
+	transitions map[State]map[State]bool
+}
+
+func NewStateMachine(transitions map[State][]State) *StateMachine {
+	sm := StateMachine{
+		transitions: map[State]map[State]bool{},
+	}
+	for from, tos := range transitions {
+		sm.transitions[from] = map[State]bool{}
+		for _, to := range tos {
+			sm.transitions[from][to] = true
+		}
+	}
+	return &sm
+}
+
+// NewTxStateMachine returns the state machine of a saga transaction.
+// A committed transaction can never be rollbacked, so abort after commit has no effect.
+// Nothing happens after the transaction is complete or aborted.
+func NewTxStateMachine() *StateMachine {
+	return NewStateMachine(map[State][]State{
+		StateNone:       {StateInProgress, StateAbort},
+		StateInProgress: {StateCommit, StateAbort, StateComplete},
+		StateCommit:     {StateComplete},
+		StateAbort:      {StateAborted},
+	})
+}
+
+func (sm *StateMachine) Can(from, to State) bool {
+	return sm.transitions[from][to]
+}
+
+// Validate accepts staying in the same state without a transition
+func (sm *StateMachine) Validate(from, to State) error {
+	if from == to || sm.Can(from, to) {
+		return nil
+	}
+	return ErrIllegalTransition
+}
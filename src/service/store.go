@@ -0,0 +1,312 @@
+package service
+
+import (
+	"sort"
+	"sync"
+)
+
+type RecordState int
+
+const (
+	RecordCommitted RecordState = iota
+	// the record is modified by a transaction which may still be rollbacked
+	RecordPending
+)
+
+// Record is an entry of the data table.
+// The TxID and the State implement semantic locking.
+type Record struct {
+	Key   string
+	Value interface{}
+	TxID  string
+	State RecordState
+	// the record is deleted by the pending transaction
+	Deleted bool
+	// the value before the pending transaction to restore on compensation
+	prev interface{}
+	// the record is created by the pending transaction
+	created bool
+}
+
+// Store is the database of a service.
+// The data and the outbox table are modified together in a local transaction.
+type Store interface {
+	Begin(txid string) StoreTx
+	Get(key string) (interface{}, bool)
+	Record(key string) (Record, bool)
+	Outbox() Outbox
+	SetOutbox(outbox Outbox)
+	// Release commits the pending records of the saga transaction
+	Release(txid string)
+	// Restore undoes the pending records of the saga transaction
+	Restore(txid string)
+	Locked(txid string) []string
+}
+
+// StoreTx is a local transaction on behalf of a saga transaction.
+// The writes are invisible until Commit and fail with ErrLocked
+// if the record is pending by another saga transaction.
+type StoreTx interface {
+	Get(key string) (interface{}, bool)
+	Put(key string, value interface{}) error
+	Delete(key string) error
+	// Restore undoes the pending records of the saga transaction on commit.
+	// Only the given keys are restored, the other writes of the saga stay pending.
+	Restore(keys ...string)
+	HasOutbox(key OutboxKey) bool
+	InsertOutbox(entry OutboxEntry) error
+	Commit() error
+	Rollback()
+}
+
+type MemoryStore struct {
+	records map[string]*Record
+	outbox  Outbox
+	mu      sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records: map[string]*Record{},
+		outbox:  NewMemoryOutbox(),
+	}
+}
+
+func (ms *MemoryStore) Begin(txid string) StoreTx {
+	return &memoryStoreTx{
+		store:  ms,
+		txid:   txid,
+		writes: map[string]memoryWrite{},
+	}
+}
+
+func (ms *MemoryStore) Get(key string) (interface{}, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.get(key)
+}
+
+func (ms *MemoryStore) get(key string) (interface{}, bool) {
+	record, ok := ms.records[key]
+	if !ok || record.Deleted {
+		return nil, false
+	}
+	return record.Value, true
+}
+
+func (ms *MemoryStore) Record(key string) (Record, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	record, ok := ms.records[key]
+	if !ok {
+		return Record{}, false
+	}
+	return *record, true
+}
+
+func (ms *MemoryStore) Outbox() Outbox {
+	return ms.outbox
+}
+
+// SetOutbox replaces the outbox table written with the data
+func (ms *MemoryStore) SetOutbox(outbox Outbox) {
+	ms.outbox = outbox
+}
+
+// Lock marks the record pending by the transaction.
+// It fails with ErrLocked if another transaction holds the record.
+func (ms *MemoryStore) Lock(key, txid string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if !ms.lockable(key, txid) {
+		return ErrLocked
+	}
+	ms.lock(key, txid)
+	return nil
+}
+
+// Put writes the record under the semantic lock of the transaction
+func (ms *MemoryStore) Put(key string, value interface{}, txid string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if !ms.lockable(key, txid) {
+		return ErrLocked
+	}
+	record := ms.lock(key, txid)
+	record.Value = value
+	record.Deleted = false
+	return nil
+}
+
+func (ms *MemoryStore) lockable(key, txid string) bool {
+	record, ok := ms.records[key]
+	return !ok || record.State != RecordPending || record.TxID == txid
+}
+
+// lock marks the record pending by the transaction, it must be lockable
+func (ms *MemoryStore) lock(key, txid string) *Record {
+	record, ok := ms.records[key]
+	if !ok {
+		record = &Record{
+			Key:     key,
+			created: true,
+		}
+		ms.records[key] = record
+	}
+	if record.State == RecordPending {
+		return record
+	}
+	record.prev = record.Value
+	record.TxID = txid
+	record.State = RecordPending
+	return record
+}
+
+func (ms *MemoryStore) Release(txid string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for key, record := range ms.records {
+		if record.State != RecordPending || record.TxID != txid {
+			continue
+		}
+		if record.Deleted {
+			delete(ms.records, key)
+			continue
+		}
+		record.State = RecordCommitted
+		record.prev = nil
+		record.created = false
+	}
+}
+
+func (ms *MemoryStore) Restore(txid string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for key := range ms.records {
+		ms.restore(key, txid)
+	}
+}
+
+// restore undoes the record if it is pending by the transaction
+func (ms *MemoryStore) restore(key, txid string) {
+	record, ok := ms.records[key]
+	if !ok || record.State != RecordPending || record.TxID != txid {
+		return
+	}
+	if record.created {
+		delete(ms.records, key)
+		return
+	}
+	record.Value = record.prev
+	record.State = RecordCommitted
+	record.Deleted = false
+	record.prev = nil
+}
+
+// Locked returns the keys locked by the transaction
+func (ms *MemoryStore) Locked(txid string) []string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	keys := []string{}
+	for key, record := range ms.records {
+		if record.State == RecordPending && record.TxID == txid {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type memoryWrite struct {
+	value   interface{}
+	deleted bool
+}
+
+type memoryStoreTx struct {
+	store   *MemoryStore
+	txid    string
+	writes  map[string]memoryWrite
+	entries []OutboxEntry
+	restore []string
+	done    bool
+}
+
+func (tx *memoryStoreTx) Get(key string) (interface{}, bool) {
+	if w, ok := tx.writes[key]; ok {
+		return w.value, !w.deleted
+	}
+	return tx.store.Get(key)
+}
+
+func (tx *memoryStoreTx) Put(key string, value interface{}) error {
+	return tx.write(key, memoryWrite{value: value})
+}
+
+func (tx *memoryStoreTx) Delete(key string) error {
+	return tx.write(key, memoryWrite{deleted: true})
+}
+
+func (tx *memoryStoreTx) write(key string, w memoryWrite) error {
+	tx.store.mu.Lock()
+	defer tx.store.mu.Unlock()
+	if !tx.store.lockable(key, tx.txid) {
+		return ErrLocked
+	}
+	tx.writes[key] = w
+	return nil
+}
+
+func (tx *memoryStoreTx) Restore(keys ...string) {
+	tx.restore = append(tx.restore, keys...)
+}
+
+func (tx *memoryStoreTx) HasOutbox(key OutboxKey) bool {
+	_, ok := tx.store.outbox.Get(key)
+	return ok
+}
+
+func (tx *memoryStoreTx) InsertOutbox(entry OutboxEntry) error {
+	if tx.HasOutbox(entry.Key) {
+		return ErrDuplicateEvent
+	}
+	tx.entries = append(tx.entries, entry)
+	return nil
+}
+
+// Commit applies the writes and the outbox entries all or nothing
+func (tx *memoryStoreTx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	ms := tx.store
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for key := range tx.writes {
+		if !ms.lockable(key, tx.txid) {
+			return ErrLocked
+		}
+	}
+	for _, entry := range tx.entries {
+		if _, ok := ms.outbox.Get(entry.Key); ok {
+			return ErrDuplicateEvent
+		}
+	}
+
+	for _, key := range tx.restore {
+		ms.restore(key, tx.txid)
+	}
+	for key, w := range tx.writes {
+		record := ms.lock(key, tx.txid)
+		record.Value = w.value
+		record.Deleted = w.deleted
+	}
+	for _, entry := range tx.entries {
+		ms.outbox.Insert(entry)
+	}
+	return nil
+}
+
+func (tx *memoryStoreTx) Rollback() {
+	tx.done = true
+}
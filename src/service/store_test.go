@@ -0,0 +1,41 @@
+package service_test
+
+import (
+	"atm/service"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStoreRestoreKeys(t *testing.T) {
+	store := service.NewMemoryStore()
+	assert.Nil(t, store.Put("order-1", "created", "tx-1"))
+	assert.Nil(t, store.Put("order-2", "created", "tx-1"))
+	assert.Equal(t, service.ErrLocked, store.Lock("order-1", "tx-2"))
+
+	// the compensation restores only its own key
+	tx := store.Begin("tx-1")
+	tx.Restore("order-1")
+	assert.Nil(t, tx.Commit())
+
+	_, ok := store.Get("order-1")
+	assert.False(t, ok)
+	value, _ := store.Get("order-2")
+	assert.Equal(t, "created", value)
+	assert.Equal(t, []string{"order-2"}, store.Locked("tx-1"))
+	assert.Nil(t, store.Lock("order-1", "tx-2"))
+}
+
+func TestMemoryStoreSetOutbox(t *testing.T) {
+	outbox := service.NewMemoryOutbox()
+	store := service.NewMemoryStore()
+	store.SetOutbox(outbox)
+
+	entry := service.OutboxEntry{Key: service.OutboxKey{TxID: "tx-1", Endpoint: "order"}}
+	tx := store.Begin("tx-1")
+	assert.Nil(t, tx.InsertOutbox(entry))
+	assert.Nil(t, tx.Commit())
+
+	_, ok := outbox.Get(entry.Key)
+	assert.True(t, ok)
+}
@@ -1,5 +1,12 @@
 package service
 
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
 type StatusEntry struct {
 	FailureType FailureType
 }
@@ -8,13 +15,34 @@ type SystemConfig struct {
 	status map[string]StatusEntry
 	report *Report
 	round  int
+	rand   *rand.Rand
+	randMu sync.Mutex
+	// the probability that the event queue delivers an event twice
+	duplicateRate float64
+	dedup         bool
+	rollbackMode  RollbackMode
+	conflict      ConflictPolicy
+	// the number of instances of each service, default to 1
+	instances map[string]int
+	// the links which cannot deliver events
+	partitions map[Link]bool
+	// the latency, loss and reordering of the links
+	profiles       map[Link]LinkProfile
+	defaultProfile LinkProfile
+	linkMu         sync.Mutex
 }
 
 func NewSystemConfig(srvs []string) *SystemConfig {
 	sc := SystemConfig{
-		status: map[string]StatusEntry{},
-		report: NewReport(),
-		round:  0,
+		status:       map[string]StatusEntry{},
+		report:       NewReport(),
+		round:        0,
+		rand:         rand.New(rand.NewSource(DefaultSeed)),
+		dedup:        true,
+		rollbackMode: RollbackConcurrent,
+		instances:    map[string]int{},
+		partitions:   map[Link]bool{},
+		profiles:     map[Link]LinkProfile{},
 	}
 
 	for _, srv := range srvs {
@@ -30,37 +58,46 @@ type System struct {
 	EventQueue *EventQueue
 	Services   map[string]Service
 	Cfg        *SystemConfig
+	// the data stores of the services with semantic locks
+	stores map[string]Store
 }
 
 func NewSystem() *System {
 	srvs := []string{
 		ServiceGateway,
 		ServiceEventQueue,
-		ServiceTxManager,
-		ServicePayment,
-		ServiceOrder,
-		ServiceCustomer,
-		ServiceShipping,
-		ServiceNotification,
 	}
 	sys := System{
 		Services: map[string]Service{},
 		Cfg:      NewSystemConfig(srvs),
+		stores:   map[string]Store{},
 	}
 
 	sys.Gateway = NewRoundGateway(&sys)
 	sys.EventQueue = NewEventQueue(&sys)
 
-	sys.Services[ServiceTxManager] = NewTxManager(&sys)
-	sys.Services[ServicePayment] = NewPaymentService(&sys)
-	sys.Services[ServiceOrder] = NewOrderService(&sys)
-	sys.Services[ServiceShipping] = NewShippingService(&sys)
-	sys.Services[ServiceCustomer] = NewCustomerService(&sys)
-	sys.Services[ServiceNotification] = NewNotificationService(&sys)
+	sys.Register(NewTxManager(&sys))
+	sys.Register(NewPaymentService(&sys))
+	sys.Register(NewOrderService(&sys))
+	sys.Register(NewShippingService(&sys))
+	sys.Register(NewCustomerService(&sys))
+	sys.Register(NewNotificationService(&sys))
 
 	return &sys
 }
 
+// Register adds the service with its queue, status entry and report bucket.
+// The events sent to a service which is not registered are dead-lettered.
+func (sys *System) Register(srv Service) {
+	name := srv.Name()
+	sys.Services[name] = srv
+	if _, ok := sys.Cfg.status[name]; !ok {
+		sys.SetStatus(name, StatusEntry{FailureType: FailureNone})
+	}
+	sys.EventQueue.Register(name)
+	sys.Cfg.report.Register(name)
+}
+
 func (sys *System) Advance() int {
 	sys.Cfg.round++
 	return sys.Cfg.round
@@ -70,10 +107,96 @@ func (sys *System) Round() int {
 	return sys.Cfg.round
 }
 
+// Seed resets the random source so that a simulation can be reproduced
+func (sys *System) Seed(seed int64) {
+	sys.Cfg.randMu.Lock()
+	defer sys.Cfg.randMu.Unlock()
+	sys.Cfg.rand = rand.New(rand.NewSource(seed))
+}
+
+// NewTag generates the tag assigned to a new event
+func (sys *System) NewTag() int {
+	sys.Cfg.randMu.Lock()
+	defer sys.Cfg.randMu.Unlock()
+	return sys.Cfg.rand.Int()
+}
+
+// Chance returns true with the given probability
+func (sys *System) Chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	sys.Cfg.randMu.Lock()
+	defer sys.Cfg.randMu.Unlock()
+	return sys.Cfg.rand.Float64() < p
+}
+
+func (sys *System) SetDuplicateRate(rate float64) {
+	sys.Cfg.duplicateRate = rate
+}
+
+func (sys *System) DuplicateRate() float64 {
+	return sys.Cfg.duplicateRate
+}
+
+// SetDeduplication turns the outbox check of the services on or off
+func (sys *System) SetDeduplication(dedup bool) {
+	sys.Cfg.dedup = dedup
+}
+
+func (sys *System) IsDeduplicated() bool {
+	return sys.Cfg.dedup
+}
+
+func (sys *System) SetRollbackMode(mode RollbackMode) {
+	sys.Cfg.rollbackMode = mode
+}
+
+func (sys *System) RollbackMode() RollbackMode {
+	return sys.Cfg.rollbackMode
+}
+
+func (sys *System) SetConflictPolicy(policy ConflictPolicy) {
+	sys.Cfg.conflict = policy
+}
+
+func (sys *System) ConflictPolicy() ConflictPolicy {
+	return sys.Cfg.conflict
+}
+
+func (sys *System) RegisterStore(srv string, store Store) {
+	sys.stores[srv] = store
+}
+
+func (sys *System) Store(srv string) Store {
+	return sys.stores[srv]
+}
+
+// StoreNames returns the services with a store in order
+func (sys *System) StoreNames() []string {
+	names := make([]string, 0, len(sys.stores))
+	for srv := range sys.stores {
+		names = append(names, srv)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (sys *System) GetService(srv string) Service {
 	return sys.Services[srv]
 }
 
+// TxManager returns the tx manager, or the state of the leader if it is replicated
+func (sys *System) TxManager() *TxManager {
+	switch tm := sys.Services[ServiceTxManager].(type) {
+	case *TxManager:
+		return tm
+	case *ReplicatedTxManager:
+		return tm.TxManager()
+	}
+	return nil
+}
+
 func (sys *System) GetStatus(srv string) StatusEntry {
 	return sys.Cfg.status[srv]
 }
@@ -82,6 +205,85 @@ func (sys *System) SetStatus(srv string, entry StatusEntry) {
 	sys.Cfg.status[srv] = entry
 }
 
+// ServiceNames returns the names of the registered services in a stable order
+func (sys *System) ServiceNames() []string {
+	names := make([]string, 0, len(sys.Services))
+	for name := range sys.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StatusNames returns every component that can be failed, including the gateway and the event queue
+func (sys *System) StatusNames() []string {
+	names := make([]string, 0, len(sys.Cfg.status))
+	for name := range sys.Cfg.status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (sys *System) IsCrashed(srv string) bool {
+	return sys.GetStatus(srv).FailureType == FailureCrash
+}
+
+// InstanceName names the i-th instance of the service
+func InstanceName(srv string, i int) string {
+	return fmt.Sprintf("%s-%d", srv, i)
+}
+
+// SetInstances runs n consumers of the queue of the service, each of them can fail on its own.
+// An instance is no more than a status, the partitions it owns and the leases of the events it pulls:
+// the events of every instance are handled by the dispatcher and the store of the single Service.
+// A crashed instance loses no work, its partitions and its expired leases are taken over by the live ones.
+func (sys *System) SetInstances(srv string, n int) {
+	if n < 1 {
+		n = 1
+	}
+	sys.Cfg.instances[srv] = n
+	for _, instance := range sys.Instances(srv) {
+		if _, ok := sys.Cfg.status[instance]; !ok {
+			sys.SetStatus(instance, StatusEntry{FailureType: FailureNone})
+		}
+	}
+}
+
+func (sys *System) Instances(srv string) []string {
+	n, ok := sys.Cfg.instances[srv]
+	if !ok {
+		n = 1
+	}
+	instances := make([]string, n)
+	for i := range instances {
+		instances[i] = InstanceName(srv, i)
+	}
+	return instances
+}
+
+// LiveInstances returns the instances which have not crashed, none if the whole service crashed
+func (sys *System) LiveInstances(srv string) []string {
+	live := []string{}
+	if sys.IsCrashed(srv) {
+		return live
+	}
+	for _, instance := range sys.Instances(srv) {
+		if !sys.IsCrashed(instance) {
+			live = append(live, instance)
+		}
+	}
+	return live
+}
+
+func (sys *System) IsCrashedAfterPull(srv string) bool {
+	return sys.GetStatus(srv).FailureType == FailureCrashAfterPull
+}
+
+func (sys *System) IsLinkBroken(srv string) bool {
+	return sys.GetStatus(srv).FailureType == FailureLinkBroken
+}
+
 func (sys *System) IsFailed(srv string) (bool, error) {
 	entry := sys.GetStatus(srv)
 	return entry.FailureType != FailureNone, nil
@@ -89,6 +291,15 @@ func (sys *System) IsFailed(srv string) (bool, error) {
 
 func (sys *System) SetFailure(srv string, failureType FailureType) error {
 	entry := sys.GetStatus(srv)
+	if srv == ServiceEventQueue && entry.FailureType != failureType {
+		if failureType == FailureCrash {
+			sys.EventQueue.Crash()
+		} else if entry.FailureType == FailureCrash {
+			if err := sys.EventQueue.Restart(); err != nil {
+				return err
+			}
+		}
+	}
 	entry.FailureType = failureType
 	sys.SetStatus(srv, entry)
 	return nil
@@ -98,6 +309,14 @@ func (sys *System) Log(srv string, msg interface{}) {
 	sys.Cfg.report.Add(srv, sys.Cfg.round, msg)
 }
 
+func (sys *System) LogDuplicate(srv string, msg interface{}) {
+	sys.Cfg.report.AddDuplicate(srv, sys.Cfg.round, msg)
+}
+
+func (sys *System) Report() *Report {
+	return sys.Cfg.report
+}
+
 func (sys *System) PrintResult() {
 	// sys.Cfg.report.SortAll()
 	// sys.Cfg.report.PrintAll()
@@ -2,86 +2,360 @@ package service
 
 import (
 	"atm/ds"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 )
 
+// TxStatus is the progress of a transaction seen by the tx manager
+type TxStatus struct {
+	TxID  string
+	State State
+	Phase Phase
+	// the last round the transaction is touched
+	Round int
+	// the round after which the transaction expires
+	Deadline int
+	// the compensations sent and acknowledged
+	RollbackSent  int
+	RollbackAcked int
+}
+
 type TxManager struct {
 	sys   *System
 	queue ds.Queue
 	// it can be marked by the user
-	progress map[string]State
-	mu       sync.Mutex
+	progress map[string]*TxStatus
+	history  map[string][]Transition
+	// the last event of each transaction to compensate on expiry
+	latest map[string]Event
+	// the release of each finished transaction, sent again with backoff in case it was lost
+	releasing map[string]Event
+	sm        *StateMachine
+	// the handled events rebuilt from the journal, and the ones answered since the restart
+	outbox  Outbox
+	handled map[string][]OutboxEntry
+	served  map[OutboxKey]bool
+	// the events to send once the change which emits them is journaled
+	outgoing []Event
+	// hold keeps the events instead of sending them, see RaftNode
+	hold func(Event)
+	// the write-ahead log of the status changes, the transactions are rebuilt from it on restart
+	journal    ds.Log
+	compaction int
+	mu         sync.Mutex
 }
 
 func NewTxManager(sys *System) *TxManager {
 	return &TxManager{
-		sys:      sys,
-		queue:    ds.NewMutexTimedPriorityQueue(&sys.Cfg.round),
-		progress: map[string]State{},
-		mu:       sync.Mutex{},
+		sys:        sys,
+		queue:      ds.NewMutexTimedPriorityQueue(&sys.Cfg.round),
+		progress:   map[string]*TxStatus{},
+		history:    map[string][]Transition{},
+		latest:     map[string]Event{},
+		releasing:  map[string]Event{},
+		handled:    map[string][]OutboxEntry{},
+		served:     map[OutboxKey]bool{},
+		sm:         NewTxStateMachine(),
+		outbox:     NewMemoryOutbox(),
+		journal:    ds.NewMemoryLog(),
+		compaction: DefaultJournalCompaction,
+		mu:         sync.Mutex{},
 	}
 }
 
+func (tm *TxManager) SetStateMachine(sm *StateMachine) {
+	tm.sm = sm
+}
+
+// SetOutbox replaces the outbox table, its entries are rebuilt from the journal on restart
+func (tm *TxManager) SetOutbox(outbox Outbox) {
+	tm.outbox = outbox
+}
+
+func (tm *TxManager) Outbox() Outbox {
+	return tm.outbox
+}
+
 func (tm *TxManager) Name() string {
 	return ServiceTxManager
 }
 
 func (tm *TxManager) Receive() {
 	eq := tm.sys.EventQueue
-	for {
-		e, err := eq.Pull(ServiceTxManager)
-		if err != nil {
-			break
+	consumed := eq.Consume(ServiceTxManager, func(e Event) {
+		// the event is handled again after its lease expires
+		if err := tm.handle(e); err != nil {
+			return
 		}
-		state := tm.getState(e.TxID)
-		switch e.Phase {
-		case PhaseBegin:
-			// nothing start, just discard the message
-			if state == StateAbort {
-				tm.setState(e.TxID, StateComplete)
-				continue
+		eq.Ack(ServiceTxManager, e)
+	})
+	if consumed {
+		tm.expire()
+	}
+}
+
+// handle processes an event pulled by the tx manager.
+// The event is journaled in the outbox with the events it emits, which are sent afterwards.
+// It fails with ErrJournal if a change cannot be journaled,
+// then the event is left out of the outbox to be handled again when it is redelivered.
+func (tm *TxManager) handle(e Event) error {
+	key := NewOutboxKey(e)
+	if entry, ok := tm.outbox.Get(key); ok && tm.sys.IsDeduplicated() {
+		tm.sys.LogDuplicate(ServiceTxManager, e)
+		// the tx manager may have crashed before sending the events, the receivers drop them if not
+		if !tm.served[key] {
+			tm.served[key] = true
+			tm.deliver(entry.Events)
+		}
+		return nil
+	}
+	state := tm.getState(e.TxID)
+	if tm.sys.IsDeduplicated() && tm.isDuplicate(state, e) {
+		tm.sys.LogDuplicate(ServiceTxManager, e)
+		return nil
+	}
+	events, err := tm.collect(func() error {
+		return tm.process(state, e)
+	})
+	if err != nil {
+		return err
+	}
+	tm.mu.Lock()
+	status := *tm.status(e.TxID)
+	err = tm.write(JournalRecord{
+		Status: status,
+		Handled: &OutboxEntry{
+			Key:    key,
+			Round:  tm.sys.Round(),
+			Events: events,
+		},
+	})
+	tm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tm.served[key] = true
+	tm.deliver(events)
+	return nil
+}
+
+// collect returns the events emitted by fn, they are dropped if it fails
+func (tm *TxManager) collect(fn func() error) ([]Event, error) {
+	tm.outgoing = []Event{}
+	err := fn()
+	events := tm.outgoing
+	tm.outgoing = nil
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (tm *TxManager) process(state State, e Event) error {
+	if err := tm.touch(e); err != nil {
+		return err
+	}
+	if (state == StateNone || state == StateInProgress) && e.Phase != PhaseRollback && e.IsExpired(tm.sys.Round()) {
+		return tm.abort(e.NewAbort(ErrTTLExpired))
+	}
+	switch e.Phase {
+	case PhaseBegin:
+		// nothing start, just discard the message
+		if state == StateAbort || state == StateAborted {
+			return nil
+		}
+		if err := tm.setState(e.TxID, StateInProgress); errors.Is(err, ErrJournal) {
+			return err
+		}
+		e.Advance()
+		e.Return()
+		e.Phase = PhaseProcessing
+		e.State = StateNone
+		e.From = ServiceTxManager
+		tm.send(e)
+
+	case PhaseProcessing:
+		if state == StateAborted {
+			// the stages reported after the transaction is aborted still need compensations
+			if e.State == StateAbort {
+				return tm.rollback(e)
+			}
+			return nil
+		}
+		if state == StateAbort {
+			return tm.rollback(e)
+		}
+		if e.State == StateCommit {
+			if err := tm.setState(e.TxID, StateCommit); errors.Is(err, ErrJournal) {
+				return err
 			}
-			tm.setState(e.TxID, StateInProgress)
 			e.Advance()
 			e.Return()
-			e.Phase = PhaseProcessing
-			e.State = StateNone
 			e.From = ServiceTxManager
-			eq.Send(e)
+			return tm.forward(e)
+		} else if e.State == StateAbort {
+			return tm.abort(e)
+		} else {
+			fmt.Printf("unkwown state: %v\n", e)
+		}
 
-		case PhaseProcessing:
-			if state == StateAbort {
-				tm.rollback(e)
-				continue
-			}
-			if e.State == StateCommit {
-				tm.setState(e.TxID, StateCommit)
-				e.Advance()
-				e.Return()
-				e.From = ServiceTxManager
-				eq.Send(e)
-			} else {
-				fmt.Printf("unkwown state: %v\n", e)
-			}
+	case PhaseEnd:
+		if state == StateAborted {
+			return nil
+		}
+		if state == StateAbort {
+			return tm.rollback(e)
+		}
+		return journaled(tm.setState(e.TxID, StateComplete))
+
+	case PhaseRollback:
+		// the compensation has been acknowledged
+		if state != StateAbort && state != StateAborted {
+			return nil
+		}
+		return tm.acknowledge(e)
+
+	default:
+		fmt.Printf("unkwown phase: %v\n", e)
+	}
+	return nil
+}
+
+// journaled keeps only the journal errors, a rejected transition leaves the event handled
+func journaled(err error) error {
+	if errors.Is(err, ErrJournal) {
+		return err
+	}
+	return nil
+}
+
+func (tm *TxManager) abort(e Event) error {
+	// abort after commit has no effect
+	if err := tm.setState(e.TxID, StateAbort); err != nil {
+		return journaled(err)
+	}
+	return tm.rollback(e)
+}
+
+// forward journals the event which drives the committed transaction to its end before it is sent,
+// so that it can be sent again if the transaction does not complete
+func (tm *TxManager) forward(e Event) error {
+	tm.mu.Lock()
+	err := tm.write(JournalRecord{Status: *tm.status(e.TxID), Latest: &e})
+	tm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tm.send(e)
+	return nil
+}
 
-		case PhaseEnd:
-			if state == StateAbort {
-				tm.rollback(e)
+// expire aborts the hung transactions whose deadline has passed.
+// Only the stages known by the tx manager are compensated here,
+// the others are compensated when their events expire in the services.
+// A committed transaction can not be aborted, its forward event is sent again with backoff
+// until it completes, in case an event after the commit was lost.
+func (tm *TxManager) expire() {
+	round := tm.sys.Round()
+	expired := []Event{}
+	forwards := []Event{}
+	tm.mu.Lock()
+	for txid, status := range tm.progress {
+		if status.Deadline <= 0 || round <= status.Deadline {
+			continue
+		}
+		latest, ok := tm.latest[txid]
+		switch status.State {
+		case StateInProgress:
+			expired = append(expired, latest.NewAbort(ErrTTLExpired))
+		case StateCommit:
+			if !ok || round < latest.Round {
 				continue
 			}
-			tm.setState(e.TxID, StateComplete)
-
-		default:
-			// Rollback Phase
-			fmt.Printf("unkwown phase: %v\n", e)
+			forwards = append(forwards, latest)
+			latest.CurrentRetryTime++
+			latest.Round = NextRetryRound(round, latest.CurrentRetryTime)
+			tm.latest[txid] = latest
 		}
 	}
+	releases := []Event{}
+	for txid, release := range tm.releasing {
+		if round < release.Round {
+			continue
+		}
+		releases = append(releases, release)
+		release.CurrentRetryTime++
+		release.RemainingRetryTime--
+		release.Round = NextRetryRound(round, release.CurrentRetryTime)
+		tm.releasing[txid] = release
+		if release.RemainingRetryTime <= 0 {
+			delete(tm.releasing, txid)
+		}
+	}
+	tm.mu.Unlock()
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].TxID < expired[j].TxID
+	})
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].TxID < releases[j].TxID
+	})
+	sort.Slice(forwards, func(i, j int) bool {
+		return forwards[i].TxID < forwards[j].TxID
+	})
+	// the abort which cannot be journaled is tried again in the next round
+	for _, e := range expired {
+		e.Round = round
+		events, err := tm.collect(func() error {
+			return tm.abort(e)
+		})
+		if err == nil {
+			tm.deliver(events)
+		}
+	}
+	// a new tag runs the stages after the commit again, the tx manager drops the repeated end
+	for _, e := range forwards {
+		e.Round = round
+		events, _ := tm.collect(func() error {
+			tm.send(e)
+			return nil
+		})
+		tm.deliver(events)
+	}
+	for _, release := range releases {
+		events, _ := tm.collect(func() error {
+			tm.release(release.TxID, release.State)
+			return nil
+		})
+		tm.deliver(events)
+	}
 }
 
-// we use concurrent rollback instead of hierarchical rollback to simplify the implementation
-func (tm *TxManager) rollback(e Event) {
-	eq := tm.sys.EventQueue
+// isDuplicate reports whether the event repeats a transition the transaction has already made.
+// The duplicates with different tags come from the retries of the gateway or the upstream stages.
+func (tm *TxManager) isDuplicate(state State, e Event) bool {
+	switch e.Phase {
+	case PhaseBegin:
+		return state == StateInProgress || state == StateCommit || state == StateComplete
+	case PhaseProcessing:
+		return e.State == StateCommit && (state == StateCommit || state == StateComplete)
+	case PhaseEnd:
+		return state == StateComplete
+	}
+	return false
+}
+
+// rollback sends the compensations in the RollbackStack.
+// In concurrent mode, all compensations are sent at once.
+// In hierarchical mode, the next compensation is sent only after the previous one is acknowledged,
+// so the stages are compensated in the reverse order of the nested endpoints.
+// The compensations are journaled before they are sent.
+func (tm *TxManager) rollback(e Event) error {
+	if e.RollbackMode == RollbackHierarchical {
+		return tm.rollbackNext(e)
+	}
+	events := []Event{}
 	for {
 		newEvent, ok := e.Rollback()
 		// empty stack
@@ -89,23 +363,205 @@ func (tm *TxManager) rollback(e Event) {
 			break
 		}
 		newEvent.Advance()
-		eq.Send(newEvent)
+		newEvent.From = ServiceTxManager
+		newEvent.RollbackStack = []string{}
+		events = append(events, newEvent)
+	}
+	if len(events) == 0 {
+		return journaled(tm.setState(e.TxID, StateAborted))
 	}
+	tm.mu.Lock()
+	status := *tm.status(e.TxID)
+	status.RollbackSent += len(events)
+	err := tm.write(JournalRecord{Status: status})
+	tm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, newEvent := range events {
+		tm.send(newEvent)
+	}
+	return nil
 }
 
-func (tm *TxManager) getState(txid string) State {
+func (tm *TxManager) rollbackNext(e Event) error {
+	newEvent, ok := e.Rollback()
+	// all compensations are done
+	if !ok {
+		return journaled(tm.setState(e.TxID, StateAborted))
+	}
+	tm.mu.Lock()
+	status := *tm.status(e.TxID)
+	status.RollbackSent++
+	err := tm.write(JournalRecord{Status: status})
+	tm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	newEvent.Advance()
+	newEvent.From = ServiceTxManager
+	tm.send(newEvent)
+	return nil
+}
+
+func (tm *TxManager) acknowledge(e Event) error {
+	tm.mu.Lock()
+	status := *tm.status(e.TxID)
+	status.RollbackAcked++
+	remaining := status.RollbackSent - status.RollbackAcked
+	err := tm.write(JournalRecord{Status: status})
+	tm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if e.RollbackMode == RollbackHierarchical {
+		return tm.rollbackNext(e)
+	}
+	if remaining <= 0 {
+		return journaled(tm.setState(e.TxID, StateAborted))
+	}
+	return nil
+}
+
+// send emits the event, it is delivered after the change is journaled
+func (tm *TxManager) send(e Event) {
+	e.Tag = tm.sys.NewTag()
+	e.CurrentRetryTime = 0
+	tm.outgoing = append(tm.outgoing, e)
+}
+
+func (tm *TxManager) deliver(events []Event) {
+	for _, e := range events {
+		if tm.hold != nil {
+			tm.hold(e)
+			continue
+		}
+		if err := tm.sys.EventQueue.Send(e); err != nil {
+			fmt.Printf("failed to send: %v (%v)\n", e, err)
+		}
+	}
+}
+
+// Status returns the status of the transaction
+func (tm *TxManager) Status(txid string) (TxStatus, bool) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
-	state, ok := tm.progress[txid]
+	status, ok := tm.progress[txid]
 	if !ok {
-		tm.progress[txid] = StateNone
-		return StateNone
+		return TxStatus{}, false
+	}
+	return *status, true
+}
+
+// StatusByState returns the status of the transactions in the state ordered by TxID
+func (tm *TxManager) StatusByState(state State) []TxStatus {
+	result := []TxStatus{}
+	for _, status := range tm.Statuses() {
+		if status.State == state {
+			result = append(result, status)
+		}
+	}
+	return result
+}
+
+// Statuses returns the status of all transactions ordered by TxID
+func (tm *TxManager) Statuses() []TxStatus {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	result := make([]TxStatus, 0, len(tm.progress))
+	for _, status := range tm.progress {
+		result = append(result, *status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].TxID < result[j].TxID
+	})
+	return result
+}
+
+// status must be called with the lock held
+func (tm *TxManager) status(txid string) *TxStatus {
+	status, ok := tm.progress[txid]
+	if !ok {
+		status = &TxStatus{
+			TxID:  txid,
+			State: StateNone,
+		}
+		tm.progress[txid] = status
+	}
+	return status
+}
+
+func (tm *TxManager) touch(e Event) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	status := *tm.status(e.TxID)
+	status.Phase = e.Phase
+	status.Round = tm.sys.Round()
+	if e.Deadline > 0 {
+		status.Deadline = e.Deadline
+	}
+	record := JournalRecord{Status: status}
+	// only a running transaction expires with its latest event
+	if status.State == StateNone || status.State == StateInProgress {
+		record.Latest = &e
+	}
+	return tm.write(record)
+}
+
+func (tm *TxManager) getState(txid string) State {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.status(txid).State
+}
+
+// setState rejects the transitions which are not allowed by the state machine
+func (tm *TxManager) setState(txid string, state State) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	status := *tm.status(txid)
+	if err := tm.sm.Validate(status.State, state); err != nil {
+		fmt.Printf("%v: %s %v -> %v\n", err, txid, status.State, state)
+		return err
+	}
+	if status.State == state {
+		return nil
+	}
+	transition := Transition{
+		From:  status.State,
+		To:    state,
+		Phase: status.Phase,
+		Round: tm.sys.Round(),
+	}
+	status.State = state
+	if err := tm.write(JournalRecord{Status: status, Transition: &transition}); err != nil {
+		return err
+	}
+	// the records can not be rollbacked any more
+	if state == StateCommit || state == StateComplete || state == StateAborted {
+		tm.release(txid, state)
+	}
+	return nil
+}
+
+// release asks every service with a store to commit the pending records of the transaction.
+// The events go through the event queue like the others, so a lost one leaves the records locked.
+func (tm *TxManager) release(txid string, state State) {
+	for _, srv := range tm.sys.StoreNames() {
+		e := NewEvent()
+		e.TxID = txid
+		e.From = ServiceTxManager
+		e.To = srv
+		e.Phase = PhaseRelease
+		e.State = state
+		e.Round = tm.sys.Round() + 1
+		e.RemainingRetryTime = DefaultRetryTime
+		tm.send(e)
 	}
-	return state
 }
 
-func (tm *TxManager) setState(txid string, state State) {
+// History returns the state transitions of the transaction in order
+func (tm *TxManager) History(txid string) []Transition {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
-	tm.progress[txid] = state
+	return append([]Transition{}, tm.history[txid]...)
 }
@@ -0,0 +1,42 @@
+package simulation
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// LoadConfig reads the simulation config from the JSON file
+func LoadConfig(path string) (*SimulationConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	simConf := NewSimulationConfig()
+	if err := json.Unmarshal(data, simConf); err != nil {
+		return nil, err
+	}
+	return simConf, nil
+}
+
+// UnmarshalJSON reads the pattern as a tagged union, see DecodePattern
+func (c *SimulationConfig) UnmarshalJSON(data []byte) error {
+	type config SimulationConfig
+	aux := struct {
+		*config
+		Pattern json.RawMessage `json:"pattern"`
+	}{
+		config: (*config)(c),
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if len(aux.Pattern) == 0 || string(aux.Pattern) == "null" {
+		return nil
+	}
+	pattern, err := DecodePattern(aux.Pattern)
+	if err != nil {
+		return err
+	}
+	c.Pattern = pattern
+	return nil
+}
@@ -0,0 +1,117 @@
+package simulation_test
+
+import (
+	"atm/service"
+	"atm/simulation"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	simConf, err := simulation.LoadConfig("../config/input.json")
+	assert.Nil(t, err)
+	assert.Equal(t, 10000, simConf.Rounds)
+
+	pattern, ok := simConf.Pattern.(*simulation.DefinedIntervalPattern)
+	assert.True(t, ok)
+	assert.Equal(t, []simulation.Interval{
+		{Start: 100, End: 200, FailureType: service.FailureCrash},
+		{Start: 400, End: 500, FailureType: service.FailureCrash},
+	}, pattern.IntervalMap[service.ServiceGateway])
+	assert.Equal(t, []simulation.Interval{
+		{Start: 200, End: 500, FailureType: service.FailureLinkBroken},
+	}, pattern.IntervalMap[service.ServicePayment])
+}
+
+func TestLoadConfigRequests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{
+		"rounds": 30,
+		"seed": 7,
+		"requests": [
+			{"timestamp": 2, "request": {"service": "payment", "endpoint": "payment_control", "body": {"Abort": true}}}
+		]
+	}`
+	assert.Nil(t, os.WriteFile(path, []byte(data), 0o644))
+
+	simConf, err := simulation.LoadConfig(path)
+	assert.Nil(t, err)
+	assert.Nil(t, simConf.Pattern)
+	assert.Equal(t, 7, simConf.Seed)
+
+	simulator := simulation.NewRoundSimultor()
+	err = simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateAborted, status.State)
+	assert.Empty(t, simulator.Verify())
+}
+
+// compensatedStages loads the config with the rollback mode and returns the stages of the rollback
+func compensatedStages(t *testing.T, mode service.RollbackMode) []service.StageCount {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := fmt.Sprintf(`{
+		"rounds": 20,
+		"rollback_mode": %d,
+		"requests": [
+			{"timestamp": 0, "request": {"service": "payment", "endpoint": "payment_control", "body": {"Abort": true}}}
+		]
+	}`, mode)
+	assert.Nil(t, os.WriteFile(path, []byte(data), 0o644))
+
+	simConf, err := simulation.LoadConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, mode, simConf.RollbackMode)
+	simConf.Output = io.Discard
+	simulator := simulation.NewRoundSimultor()
+	err = simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateAborted, status.State)
+	assert.Equal(t, 3, status.RollbackAcked)
+	// the stages after the abort decision of the tx manager
+	return simulator.Sys.Report().Stages()[9:]
+}
+
+func TestLoadConfigRollbackMode(t *testing.T) {
+	// the compensations are sent at once in concurrent mode
+	concurrent := compensatedStages(t, service.RollbackConcurrent)
+	assertStages(t, []service.StageCount{
+		{Round: 10, Stage: "customer|customer|0"},
+		{Round: 10, Stage: "order|order|0"},
+		{Round: 10, Stage: "shipping|shipping|0"},
+		{Round: 11, Stage: "tx_manager|customer|0"},
+		{Round: 11, Stage: "tx_manager|order|0"},
+		{Round: 11, Stage: "tx_manager|shipping|0"},
+	}, concurrent)
+
+	// the system-wide hierarchical mode compensates one stage after another in reverse order
+	hierarchical := compensatedStages(t, service.RollbackHierarchical)
+	assertStages(t, []service.StageCount{
+		{Round: 10, Stage: "customer|customer|0"},
+		{Round: 11, Stage: "tx_manager|customer|0"},
+		{Round: 12, Stage: "shipping|shipping|0"},
+		{Round: 13, Stage: "tx_manager|shipping|0"},
+		{Round: 14, Stage: "order|order|0"},
+		{Round: 15, Stage: "tx_manager|order|0"},
+	}, hierarchical)
+}
+
+func TestUnknownServiceInPattern(t *testing.T) {
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		"executor": {
+			{Start: 1, End: 2, FailureType: service.FailureCrash},
+		},
+	}
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	err := simulator.Simulate(*simConf)
+	assert.ErrorIs(t, err, service.ErrUnknownService)
+}
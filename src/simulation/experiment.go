@@ -0,0 +1,168 @@
+package simulation
+
+import (
+	"atm/service"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const DefaultExperimentRounds = 10
+
+var (
+	DefaultSweepRates = []float64{0.1, 0.25, 0.5, 0.75}
+	DefaultSweepSeeds = []int{1, 2, 3, 4, 5}
+)
+
+// DuplicateRow compares the number of events delivered to a stage in a round with and without deduplication
+type DuplicateRow struct {
+	Round int
+	Stage string
+	// the events delivered without deduplication
+	Events int
+	// the events delivered and suppressed with deduplication
+	DedupEvents     int
+	DedupSuppressed int
+}
+
+// DuplicateExperiment duplicates every event with the given probability.
+// Without the tag in the outbox, each duplicate is processed and doubles the events of the next stage.
+type DuplicateExperiment struct {
+	Rounds int
+	Rate   float64
+	Seed   int
+}
+
+func NewDuplicateExperiment(rounds int, rate float64) *DuplicateExperiment {
+	return &DuplicateExperiment{
+		Rounds: rounds,
+		Rate:   rate,
+		Seed:   DefaultSeed,
+	}
+}
+
+func (de *DuplicateExperiment) Run() ([]DuplicateRow, error) {
+	rows := map[service.StageCount]*DuplicateRow{}
+	keys := []service.StageCount{}
+	for _, disableDedup := range []bool{true, false} {
+		simulator := NewRoundSimultor()
+		simConf := NewSimulationConfig()
+		simConf.Rounds = de.Rounds
+		simConf.Seed = de.Seed
+		simConf.DuplicateRate = de.Rate
+		simConf.DisableDedup = disableDedup
+		simConf.Output = io.Discard
+		if err := simulator.Simulate(*simConf); err != nil {
+			return nil, err
+		}
+
+		for _, sc := range simulator.Sys.Report().Stages() {
+			// the events sent in the last round are never processed
+			if sc.Round >= de.Rounds {
+				continue
+			}
+			key := service.StageCount{Round: sc.Round, Stage: sc.Stage}
+			row, ok := rows[key]
+			if !ok {
+				row = &DuplicateRow{
+					Round: sc.Round,
+					Stage: sc.Stage,
+				}
+				rows[key] = row
+				keys = append(keys, key)
+			}
+			if disableDedup {
+				row.Events = sc.Events
+			} else {
+				row.DedupEvents = sc.Events
+				row.DedupSuppressed = sc.Suppressed
+			}
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Round != keys[j].Round {
+			return keys[i].Round < keys[j].Round
+		}
+		return keys[i].Stage < keys[j].Stage
+	})
+	result := make([]DuplicateRow, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, *rows[key])
+	}
+	return result, nil
+}
+
+func PrintDuplicateTable(w io.Writer, rows []DuplicateRow) {
+	fmt.Fprintf(w, "%-6s %-36s %10s %10s %10s\n", "round", "stage", "no-dedup", "dedup", "suppressed")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%-6d %-36s %10d %10d %10d\n",
+			row.Round,
+			row.Stage,
+			row.Events,
+			row.DedupEvents,
+			row.DedupSuppressed)
+	}
+}
+
+// DuplicateSweepRow is the mean number of events of a run over the seeds at a duplicate rate
+type DuplicateSweepRow struct {
+	Rate            float64
+	Events          float64
+	DedupEvents     float64
+	DedupSuppressed float64
+}
+
+// DuplicateSweep runs the duplicate experiment at each rate with each seed.
+// The fractional rates are random, so a single seed tells little about the amplification.
+type DuplicateSweep struct {
+	Rounds int
+	Rates  []float64
+	Seeds  []int
+}
+
+func NewDuplicateSweep(rounds int) *DuplicateSweep {
+	return &DuplicateSweep{
+		Rounds: rounds,
+		Rates:  DefaultSweepRates,
+		Seeds:  DefaultSweepSeeds,
+	}
+}
+
+func (sw *DuplicateSweep) Run() ([]DuplicateSweepRow, error) {
+	result := make([]DuplicateSweepRow, 0, len(sw.Rates))
+	for _, rate := range sw.Rates {
+		sum := DuplicateSweepRow{Rate: rate}
+		for _, seed := range sw.Seeds {
+			experiment := NewDuplicateExperiment(sw.Rounds, rate)
+			experiment.Seed = seed
+			rows, err := experiment.Run()
+			if err != nil {
+				return nil, err
+			}
+			for _, row := range rows {
+				sum.Events += float64(row.Events)
+				sum.DedupEvents += float64(row.DedupEvents)
+				sum.DedupSuppressed += float64(row.DedupSuppressed)
+			}
+		}
+		if n := float64(len(sw.Seeds)); n > 0 {
+			sum.Events /= n
+			sum.DedupEvents /= n
+			sum.DedupSuppressed /= n
+		}
+		result = append(result, sum)
+	}
+	return result, nil
+}
+
+func PrintDuplicateSweepTable(w io.Writer, rows []DuplicateSweepRow) {
+	fmt.Fprintf(w, "%-6s %10s %10s %10s\n", "rate", "no-dedup", "dedup", "suppressed")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%-6.2f %10.1f %10.1f %10.1f\n",
+			row.Rate,
+			row.Events,
+			row.DedupEvents,
+			row.DedupSuppressed)
+	}
+}
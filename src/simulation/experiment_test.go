@@ -0,0 +1,55 @@
+package simulation_test
+
+import (
+	"atm/simulation"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDuplicateExperiment(t *testing.T) {
+	rounds := 10
+	experiment := simulation.NewDuplicateExperiment(rounds, 1.0)
+	rows, err := experiment.Run()
+	assert.Nil(t, err)
+	assert.Equal(t, rounds-1, len(rows))
+
+	// the duplicate events grow exponentially without the tag
+	// while the tag suppresses them in every stage
+	for i, row := range rows {
+		assert.Equal(t, i+1, row.Round)
+		assert.Equal(t, 1<<row.Round, row.Events)
+		assert.Equal(t, 2, row.DedupEvents)
+		assert.Equal(t, 1, row.DedupSuppressed)
+	}
+
+	var buf bytes.Buffer
+	simulation.PrintDuplicateTable(&buf, rows)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, len(rows)+1, len(lines))
+	assert.Contains(t, lines[2], "payment|payment_control|0")
+}
+
+func TestDuplicateSweep(t *testing.T) {
+	sweep := simulation.NewDuplicateSweep(8)
+	sweep.Rates = []float64{0.25, 0.75}
+	sweep.Seeds = []int{1, 2, 3}
+	rows, err := sweep.Run()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(rows))
+
+	// the tag suppresses the duplicates at every rate, and more duplicates are amplified at a higher rate
+	for _, row := range rows {
+		assert.Greater(t, row.Events, row.DedupEvents)
+		assert.Greater(t, row.DedupSuppressed, 0.0)
+	}
+	assert.Greater(t, rows[1].Events, rows[0].Events)
+
+	var buf bytes.Buffer
+	simulation.PrintDuplicateSweepTable(&buf, rows)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, len(rows)+1, len(lines))
+	assert.True(t, strings.HasPrefix(lines[1], "0.25"))
+}
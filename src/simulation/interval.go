@@ -2,14 +2,57 @@ package simulation
 
 import (
 	"atm/service"
+	"errors"
+	"fmt"
 	"sort"
 )
 
+var (
+	ErrInvalidInterval     = errors.New("invalid interval")
+	ErrOverlappingInterval = errors.New("overlapping intervals with different failure types")
+)
+
+// Interval is the rounds from Start to End, both inclusive, in which the service fails
 type Interval struct {
-	Start       int
-	End         int
-	Status      service.Status
-	FailureType service.FailureType
+	Start       int                 `json:"start"`
+	End         int                 `json:"end"`
+	Status      service.Status      `json:"status,omitempty"`
+	FailureType service.FailureType `json:"failure"`
+}
+
+func (i Interval) validate() error {
+	if i.Start < 0 || i.End < i.Start {
+		return fmt.Errorf("%w: [%d, %d]", ErrInvalidInterval, i.Start, i.End)
+	}
+	return nil
+}
+
+// LinkInterval partitions the link in the rounds from Start to End, the link heals after End
+type LinkInterval struct {
+	service.Link
+	Start int `json:"start"`
+	End   int `json:"end"`
+	// partition the link back to the sender as well
+	Both bool `json:"both,omitempty"`
+}
+
+func (i LinkInterval) validate() error {
+	if i.Start < 0 || i.End < i.Start {
+		return fmt.Errorf("%w: %s -> %s [%d, %d]", ErrInvalidInterval, i.From, i.To, i.Start, i.End)
+	}
+	return nil
+}
+
+// links returns the partitioned links at the round
+func (i LinkInterval) links(round int) []service.Link {
+	if round < i.Start || round > i.End {
+		return []service.Link{}
+	}
+	links := []service.Link{i.Link}
+	if i.Both {
+		links = append(links, service.Link{From: i.To, To: i.From})
+	}
+	return links
 }
 
 // https://pkg.go.dev/sort
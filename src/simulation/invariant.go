@@ -0,0 +1,137 @@
+package simulation
+
+import (
+	"atm/service"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrInvariant = errors.New("invariant violated")
+
+// Verify checks the invariants of the transactions after the simulation:
+// every transaction has finished, an aborted one has all its compensations acknowledged,
+// no record is left locked by a finished transaction,
+// a transaction which lost an event is aborted once its deadline passes,
+// and the tx manager has not forgotten a decided transaction after a restart.
+func (rs *RoundSimulator) Verify() []error {
+	errs := append([]error{}, rs.recoveryErrs...)
+	sys := rs.Sys
+	lost := map[string]service.Event{}
+	for _, e := range sys.EventQueue.Dropped() {
+		if _, ok := lost[e.TxID]; !ok {
+			lost[e.TxID] = e
+		}
+	}
+	for _, status := range sys.Gateway.QueryAll() {
+		switch status.State {
+		case service.StateComplete:
+		case service.StateAborted:
+			if status.RollbackAcked < status.RollbackSent {
+				errs = append(errs, fmt.Errorf("%w: %s has %d compensations not acknowledged",
+					ErrInvariant, status.TxID, status.RollbackSent-status.RollbackAcked))
+			}
+		default:
+			if e, ok := lost[status.TxID]; ok {
+				errs = append(errs, fmt.Errorf("%w: %s lost the event %s -> %s and has not expired (deadline %d)",
+					ErrInvariant, status.TxID, e.From, e.To, e.Deadline))
+				continue
+			}
+			// the transaction may still finish before its deadline
+			if status.Deadline > 0 && sys.Round() <= status.Deadline {
+				continue
+			}
+			errs = append(errs, fmt.Errorf("%w: %s has not finished (%v)", ErrInvariant, status.TxID, status.State))
+			continue
+		}
+		for _, srv := range sys.ServiceNames() {
+			store := sys.Store(srv)
+			if store == nil {
+				continue
+			}
+			if keys := store.Locked(status.TxID); len(keys) > 0 {
+				errs = append(errs, fmt.Errorf("%w: %s leaves %v locked in %s", ErrInvariant, status.TxID, keys, srv))
+			}
+		}
+	}
+	return errs
+}
+
+func isDecided(state service.State) bool {
+	switch state {
+	case service.StateCommit, service.StateComplete, service.StateAbort, service.StateAborted:
+		return true
+	}
+	return false
+}
+
+// isKept reports whether the decision survives, a decided transaction may only finish
+func isKept(before, after service.State) bool {
+	return before == after ||
+		(before == service.StateCommit && after == service.StateComplete) ||
+		(before == service.StateAbort && after == service.StateAborted)
+}
+
+// checkpoint keeps the decided transactions before the tx manager crashes.
+// For a replicated tx manager they are taken from the committed entries of the crashing leader
+// and compared with the next leader after it is elected.
+func (rs *RoundSimulator) checkpoint() {
+	var statuses []service.TxStatus
+	rs.term = 0
+	switch tm := rs.Sys.GetService(service.ServiceTxManager).(type) {
+	case *service.TxManager:
+		statuses = tm.Statuses()
+	case *service.ReplicatedTxManager:
+		leader := tm.Leader()
+		if leader == nil {
+			return
+		}
+		committed, err := leader.Committed()
+		if err != nil {
+			rs.recoveryErrs = append(rs.recoveryErrs, err)
+			return
+		}
+		statuses = committed
+		rs.term = leader.Term()
+	}
+	rs.decided = map[string]service.TxStatus{}
+	for _, status := range statuses {
+		if isDecided(status.State) {
+			rs.decided[status.TxID] = status
+		}
+	}
+}
+
+// isElected reports whether a leader of a later term than the checkpoint has been elected
+func (rs *RoundSimulator) isElected() bool {
+	tm, ok := rs.Sys.GetService(service.ServiceTxManager).(*service.ReplicatedTxManager)
+	if !ok || rs.decided == nil {
+		return false
+	}
+	leader := tm.Leader()
+	return leader != nil && leader.Term() > rs.term
+}
+
+// checkRecovery compares the transactions rebuilt by the tx manager with the checkpoint
+func (rs *RoundSimulator) checkRecovery() {
+	txids := []string{}
+	for txid := range rs.decided {
+		txids = append(txids, txid)
+	}
+	sort.Strings(txids)
+	for _, txid := range txids {
+		before := rs.decided[txid]
+		after, ok := rs.Sys.TxManager().Status(txid)
+		if !ok || !isKept(before.State, after.State) {
+			rs.recoveryErrs = append(rs.recoveryErrs, fmt.Errorf("%w: %s is %v before the tx manager crashed but %v after recovery",
+				ErrInvariant, txid, before.State, after.State))
+		}
+	}
+	rs.decided = nil
+	rs.recoveries++
+}
+
+// Recoveries returns how many times the tx manager has been checked after a crash
+func (rs *RoundSimulator) Recoveries() int {
+	return rs.recoveries
+}
@@ -1,6 +1,16 @@
 package simulation
 
-import "atm/service"
+import (
+	"atm/service"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	ErrUnknownPattern = errors.New("unknown pattern")
+	ErrInvalidPattern = errors.New("invalid pattern")
+)
 
 var BasicPattern DefinedIntervalPattern
 
@@ -9,47 +19,81 @@ func init() {
 	BasicPattern.IntervalMap = map[string][]Interval{
 		service.ServiceGateway: {
 			{
-				Start: 1,
-				End:   2,
+				Start:       1,
+				End:         2,
+				FailureType: service.FailureCrash,
 			},
 			{
-				Start: 3,
-				End:   4,
+				Start:       3,
+				End:         4,
+				FailureType: service.FailureCrash,
 			},
 			{
-				Start: 7,
-				End:   8,
+				Start:       7,
+				End:         8,
+				FailureType: service.FailureLinkBroken,
 			},
 		},
 		service.ServiceCustomer: {
 			{
-				Start: 1,
-				End:   5,
+				Start:       1,
+				End:         5,
+				FailureType: service.FailureCrash,
 			},
 			{
-				Start: 3,
-				End:   7,
+				Start:       3,
+				End:         7,
+				FailureType: service.FailureCrash,
 			},
 			{
-				Start: 8,
-				End:   9,
+				Start:       8,
+				End:         9,
+				FailureType: service.FailureLinkBroken,
 			},
 			{
-				Start: 12,
-				End:   15,
+				Start:       12,
+				End:         15,
+				FailureType: service.FailureCrash,
 			},
 		},
 	}
 }
 
+// NamedPattern returns a fresh copy of the pattern selected by name
+func NamedPattern(name string) (FailurePattern, error) {
+	switch name {
+	case "default", "none":
+		pattern := NewDefinedIntervalPattern()
+		return &pattern, nil
+	case "basic":
+		pattern := BasicPattern.Copy()
+		return &pattern, nil
+	case "random":
+		pattern := NewRandomPattern()
+		return &pattern, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownPattern, name)
+}
+
 type FailurePattern interface {
+	// Type is the tag of the pattern in JSON
+	Type() string
+	// Prepare fills the parameters left to the simulation before Init
+	Prepare(services []string, rounds int, seed int64)
 	Init() error
 	Get(string, int) (service.FailureType, bool)
 }
 
+// LinkPattern partitions the links between the components
+type LinkPattern interface {
+	PartitionedLinks(round int) []service.Link
+}
+
 type DefinedIntervalPattern struct {
-	IntervalMap map[string][]Interval
-	ProgressMap map[string]int
+	IntervalMap map[string][]Interval `json:"intervals"`
+	ProgressMap map[string]int        `json:"-"`
+	// the partitions of the links between the components
+	Links []LinkInterval `json:"links,omitempty"`
 }
 
 func NewDefinedIntervalPattern() DefinedIntervalPattern {
@@ -59,7 +103,53 @@ func NewDefinedIntervalPattern() DefinedIntervalPattern {
 	}
 }
 
+// Copy returns the pattern with its own intervals and progress
+func (p *DefinedIntervalPattern) Copy() DefinedIntervalPattern {
+	pattern := NewDefinedIntervalPattern()
+	for srv, intervals := range p.IntervalMap {
+		pattern.IntervalMap[srv] = append([]Interval{}, intervals...)
+	}
+	pattern.Links = append([]LinkInterval{}, p.Links...)
+	return pattern
+}
+
+func (p *DefinedIntervalPattern) Type() string {
+	return PatternDefinedInterval
+}
+
+// Services returns the names of the failed components
+func (p *DefinedIntervalPattern) Services() []string {
+	seen := map[string]bool{}
+	for srv := range p.IntervalMap {
+		seen[srv] = true
+	}
+	for _, link := range p.Links {
+		seen[link.From] = true
+		seen[link.To] = true
+	}
+	services := []string{}
+	for srv := range seen {
+		services = append(services, srv)
+	}
+	sort.Strings(services)
+	return services
+}
+
+func (p *DefinedIntervalPattern) PartitionedLinks(round int) []service.Link {
+	links := []service.Link{}
+	for _, link := range p.Links {
+		links = append(links, link.links(round)...)
+	}
+	return links
+}
+
+// Prepare does nothing, the intervals are given
+func (p *DefinedIntervalPattern) Prepare(services []string, rounds int, seed int64) {}
+
 func (p *DefinedIntervalPattern) Init() error {
+	if err := p.validate(); err != nil {
+		return err
+	}
 	if err := p.sort(); err != nil {
 		return err
 	}
@@ -74,17 +164,17 @@ func (p *DefinedIntervalPattern) Init() error {
 }
 
 func (p *DefinedIntervalPattern) Get(srv string, round int) (service.FailureType, bool) {
-	if !p.hasNext(srv) {
-		return service.FailureNone, false
-	}
-	idx := p.ProgressMap[srv]
-	interval := p.IntervalMap[srv][idx]
-	if round >= interval.Start && round <= interval.End {
-		return interval.FailureType, true
-	} else if round < interval.Start {
-		return service.FailureNone, false
+	// skip the intervals which have already passed
+	for p.hasNext(srv) {
+		idx := p.ProgressMap[srv]
+		interval := p.IntervalMap[srv][idx]
+		if round >= interval.Start && round <= interval.End {
+			return interval.FailureType, true
+		} else if round < interval.Start {
+			return service.FailureNone, false
+		}
+		p.advance(srv)
 	}
-	p.advance(srv)
 	return service.FailureNone, false
 }
 
@@ -98,6 +188,22 @@ func (p *DefinedIntervalPattern) advance(srv string) (Interval, error) {
 	return p.IntervalMap[srv][idx], nil
 }
 
+func (p *DefinedIntervalPattern) validate() error {
+	for srv, intervals := range p.IntervalMap {
+		for _, interval := range intervals {
+			if err := interval.validate(); err != nil {
+				return fmt.Errorf("%s: %w", srv, err)
+			}
+		}
+	}
+	for _, link := range p.Links {
+		if err := link.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (p *DefinedIntervalPattern) sort() error {
 	start := func(p1, p2 *Interval) bool {
 		return p1.Start < p2.Start
@@ -120,8 +226,15 @@ func (p *DefinedIntervalPattern) merge() error {
 		interval := intervals[0]
 		for i := 1; i < len(intervals); i++ {
 			nextInterval := intervals[i]
-			if nextInterval.Start >= interval.Start && nextInterval.Start <= interval.End+1 {
-				interval.End = nextInterval.End
+			// the failure of a round must be unambiguous
+			if nextInterval.Start <= interval.End && nextInterval.FailureType != interval.FailureType {
+				return fmt.Errorf("%w: %s [%d, %d] and [%d, %d]", ErrOverlappingInterval, service,
+					interval.Start, interval.End, nextInterval.Start, nextInterval.End)
+			}
+			if nextInterval.Start <= interval.End+1 && nextInterval.FailureType == interval.FailureType {
+				if nextInterval.End > interval.End {
+					interval.End = nextInterval.End
+				}
 			} else {
 				newIntervals = append(newIntervals, interval)
 				interval = nextInterval
@@ -0,0 +1,63 @@
+package simulation
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// the tags of the patterns in JSON
+const (
+	PatternDefinedInterval = "defined_interval"
+	PatternRandom          = "random"
+)
+
+var patternTypes = map[string]func() FailurePattern{
+	PatternDefinedInterval: func() FailurePattern {
+		pattern := NewDefinedIntervalPattern()
+		return &pattern
+	},
+	PatternRandom: func() FailurePattern {
+		pattern := NewRandomPattern()
+		return &pattern
+	},
+}
+
+// DecodePattern reads the pattern tagged by its type, e.g.
+// {"type": "defined_interval", "intervals": {"gateway": [{"start": 1, "end": 2, "failure": "crash"}]}}
+func DecodePattern(data []byte) (FailurePattern, error) {
+	tag := struct {
+		Type string `json:"type"`
+	}{}
+	if err := json.Unmarshal(data, &tag); err != nil {
+		return nil, err
+	}
+	newPattern, ok := patternTypes[tag.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w: type %q", ErrUnknownPattern, tag.Type)
+	}
+	pattern := newPattern()
+	if err := json.Unmarshal(data, pattern); err != nil {
+		return nil, err
+	}
+	return pattern, nil
+}
+
+// encodePattern writes the fields of the pattern with its type
+func encodePattern(pattern FailurePattern, fields interface{}) ([]byte, error) {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	tagged := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &tagged); err != nil {
+		return nil, err
+	}
+	tag, _ := json.Marshal(pattern.Type())
+	tagged["type"] = tag
+	return json.Marshal(tagged)
+}
+
+func (p *DefinedIntervalPattern) MarshalJSON() ([]byte, error) {
+	type fields DefinedIntervalPattern
+	return encodePattern(p, (*fields)(p))
+}
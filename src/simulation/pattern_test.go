@@ -3,6 +3,7 @@ package simulation_test
 import (
 	"atm/service"
 	"atm/simulation"
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -132,3 +133,139 @@ func TestFailurePattern(t *testing.T) {
 	assert.False(t, isFailed)
 	assert.Equal(t, resultType, service.FailureNone)
 }
+
+func TestFailurePatternSkipInterval(t *testing.T) {
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		service.ServiceOrder: {
+			{
+				Start:       1,
+				End:         2,
+				FailureType: service.FailureCrash,
+			},
+			{
+				Start:       5,
+				End:         6,
+				FailureType: service.FailureLinkBroken,
+			},
+		},
+	}
+
+	pattern.Init()
+
+	// the first interval is skipped without being observed
+	resultType, isFailed := pattern.Get(service.ServiceOrder, 5)
+	assert.True(t, isFailed)
+	assert.Equal(t, resultType, service.FailureLinkBroken)
+}
+
+func TestNamedPattern(t *testing.T) {
+	pattern, err := simulation.NamedPattern("basic")
+	assert.Nil(t, err)
+	assert.Nil(t, pattern.Init())
+	// the basic pattern injects both kinds of failures
+	failureType, _ := pattern.Get(service.ServiceGateway, 1)
+	assert.Equal(t, service.FailureCrash, failureType)
+	failureType, _ = pattern.Get(service.ServiceCustomer, 8)
+	assert.Equal(t, service.FailureLinkBroken, failureType)
+	pattern.Get(service.ServiceCustomer, 20)
+
+	// every selection gets its own progress
+	basic := pattern.(*simulation.DefinedIntervalPattern)
+	assert.Equal(t, 0, simulation.BasicPattern.ProgressMap[service.ServiceCustomer])
+	assert.Equal(t, len(basic.IntervalMap[service.ServiceCustomer]), basic.ProgressMap[service.ServiceCustomer])
+
+	_, err = simulation.NamedPattern("unknown")
+	assert.ErrorIs(t, err, simulation.ErrUnknownPattern)
+}
+
+func TestPatternJSON(t *testing.T) {
+	data := `{
+		"type": "defined_interval",
+		"intervals": {
+			"order": [
+				{"start": 5, "end": 6, "failure": "link_broken"},
+				{"start": 1, "end": 2, "failure": "crash"}
+			]
+		}
+	}`
+	pattern, err := simulation.DecodePattern([]byte(data))
+	assert.Nil(t, err)
+	assert.Nil(t, pattern.Init())
+	resultType, isFailed := pattern.Get(service.ServiceOrder, 2)
+	assert.True(t, isFailed)
+	assert.Equal(t, service.FailureCrash, resultType)
+
+	// the type and the failure names are written back
+	encoded, err := json.Marshal(pattern)
+	assert.Nil(t, err)
+	decoded, err := simulation.DecodePattern(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, pattern.(*simulation.DefinedIntervalPattern).IntervalMap,
+		decoded.(*simulation.DefinedIntervalPattern).IntervalMap)
+	assert.Contains(t, string(encoded), `"failure":"link_broken"`)
+
+	_, err = simulation.DecodePattern([]byte(`{"type": "periodic"}`))
+	assert.ErrorIs(t, err, simulation.ErrUnknownPattern)
+	_, err = simulation.DecodePattern([]byte(`{"type": "defined_interval", "intervals": {"order": [{"start": 1, "end": 2, "failure": "flood"}]}}`))
+	assert.ErrorIs(t, err, service.ErrUnknownFailureType)
+}
+
+func TestPatternValidation(t *testing.T) {
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		service.ServiceOrder: {
+			{Start: 3, End: 1, FailureType: service.FailureCrash},
+		},
+	}
+	assert.ErrorIs(t, pattern.Init(), simulation.ErrInvalidInterval)
+
+	pattern = simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		service.ServiceOrder: {
+			{Start: 1, End: 5, FailureType: service.FailureCrash},
+			{Start: 4, End: 8, FailureType: service.FailureLinkBroken},
+		},
+	}
+	assert.ErrorIs(t, pattern.Init(), simulation.ErrOverlappingInterval)
+
+	// an interval inside another one of the same failure type is merged
+	pattern = simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		service.ServiceOrder: {
+			{Start: 1, End: 8, FailureType: service.FailureCrash},
+			{Start: 2, End: 3, FailureType: service.FailureCrash},
+			{Start: 9, End: 10, FailureType: service.FailureLinkBroken},
+		},
+	}
+	assert.Nil(t, pattern.Init())
+	assert.Equal(t, []simulation.Interval{
+		{Start: 1, End: 8, FailureType: service.FailureCrash},
+		{Start: 9, End: 10, FailureType: service.FailureLinkBroken},
+	}, pattern.IntervalMap[service.ServiceOrder])
+}
+
+func TestLinkPatternJSON(t *testing.T) {
+	data := `{
+		"type": "defined_interval",
+		"links": [
+			{"from": "order", "to": "shipping", "start": 2, "end": 4, "both": true}
+		]
+	}`
+	pattern, err := simulation.DecodePattern([]byte(data))
+	assert.Nil(t, err)
+	assert.Nil(t, pattern.Init())
+
+	lp := pattern.(simulation.LinkPattern)
+	assert.Empty(t, lp.PartitionedLinks(1))
+	assert.Equal(t, []service.Link{
+		{From: service.ServiceOrder, To: service.ServiceShipping},
+		{From: service.ServiceShipping, To: service.ServiceOrder},
+	}, lp.PartitionedLinks(3))
+	// the link heals after the interval
+	assert.Empty(t, lp.PartitionedLinks(5))
+
+	invalid, err := simulation.DecodePattern([]byte(`{"type": "defined_interval", "links": [{"from": "order", "to": "shipping", "start": 4, "end": 2}]}`))
+	assert.Nil(t, err)
+	assert.ErrorIs(t, invalid.Init(), simulation.ErrInvalidInterval)
+}
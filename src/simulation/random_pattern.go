@@ -0,0 +1,118 @@
+package simulation
+
+import (
+	"atm/service"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const (
+	DefaultMTBF           = 20
+	DefaultMTTR           = 3
+	DefaultLinkBrokenRate = 0.2
+)
+
+// RandomPattern generates the failure intervals of each service from the mean time between failures
+// and the mean time to repair, both in rounds and exponentially distributed.
+// The same seed always generates the same intervals.
+type RandomPattern struct {
+	// the failed components, default to every service
+	ServiceNames []string `json:"services"`
+	MTBF         float64  `json:"mtbf"`
+	MTTR         float64  `json:"mttr"`
+	// the fraction of the failures which break the link instead of crashing the service
+	LinkBrokenRate float64 `json:"link_broken_rate"`
+	// the rounds to generate, default to the rounds of the simulation
+	Rounds *int `json:"rounds,omitempty"`
+	// default to the seed of the simulation, 0 is a valid seed
+	Seed    *int64 `json:"seed,omitempty"`
+	pattern DefinedIntervalPattern
+}
+
+func NewRandomPattern() RandomPattern {
+	return RandomPattern{
+		ServiceNames:   []string{},
+		MTBF:           DefaultMTBF,
+		MTTR:           DefaultMTTR,
+		LinkBrokenRate: DefaultLinkBrokenRate,
+		pattern:        NewDefinedIntervalPattern(),
+	}
+}
+
+func (p *RandomPattern) Type() string {
+	return PatternRandom
+}
+
+func (p *RandomPattern) Services() []string {
+	return p.ServiceNames
+}
+
+// Prepare fills the parameters which are not set with the ones of the simulation
+func (p *RandomPattern) Prepare(services []string, rounds int, seed int64) {
+	if len(p.ServiceNames) == 0 {
+		p.ServiceNames = services
+	}
+	if p.Rounds == nil {
+		p.Rounds = &rounds
+	}
+	if p.Seed == nil {
+		p.Seed = &seed
+	}
+}
+
+// Init generates the intervals of the services in a stable order
+func (p *RandomPattern) Init() error {
+	if p.MTBF <= 0 || p.MTTR <= 0 || p.LinkBrokenRate < 0 || p.LinkBrokenRate > 1 {
+		return ErrInvalidPattern
+	}
+	if p.Rounds == nil || p.Seed == nil {
+		p.Prepare(p.ServiceNames, DefaultRounds, DefaultSeed)
+	}
+	r := rand.New(rand.NewSource(*p.Seed))
+	services := append([]string{}, p.ServiceNames...)
+	sort.Strings(services)
+
+	p.pattern = NewDefinedIntervalPattern()
+	for _, srv := range services {
+		intervals := []Interval{}
+		round := 0
+		for {
+			start := round + int(math.Ceil(r.ExpFloat64()*p.MTBF))
+			if start >= *p.Rounds {
+				break
+			}
+			duration := int(math.Ceil(r.ExpFloat64() * p.MTTR))
+			if duration < 1 {
+				duration = 1
+			}
+			failureType := service.FailureCrash
+			if r.Float64() < p.LinkBrokenRate {
+				failureType = service.FailureLinkBroken
+			}
+			intervals = append(intervals, Interval{
+				Start:       start,
+				End:         start + duration - 1,
+				FailureType: failureType,
+			})
+			// the next failure happens after the repair
+			round = start + duration
+		}
+		p.pattern.IntervalMap[srv] = intervals
+	}
+	return p.pattern.Init()
+}
+
+func (p *RandomPattern) Get(srv string, round int) (service.FailureType, bool) {
+	return p.pattern.Get(srv, round)
+}
+
+// Intervals returns the generated intervals of the service
+func (p *RandomPattern) Intervals(srv string) []Interval {
+	return append([]Interval{}, p.pattern.IntervalMap[srv]...)
+}
+
+func (p *RandomPattern) MarshalJSON() ([]byte, error) {
+	type fields RandomPattern
+	return encodePattern(p, (*fields)(p))
+}
@@ -0,0 +1,127 @@
+package simulation_test
+
+import (
+	"atm/service"
+	"atm/simulation"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newRandomPattern(seed int64) *simulation.RandomPattern {
+	pattern := simulation.NewRandomPattern()
+	pattern.ServiceNames = []string{service.ServiceOrder, service.ServiceShipping}
+	pattern.LinkBrokenRate = 0.5
+	rounds := 1000
+	pattern.Rounds = &rounds
+	pattern.Seed = &seed
+	return &pattern
+}
+
+func TestRandomPattern(t *testing.T) {
+	pattern := newRandomPattern(7)
+	assert.Nil(t, pattern.Init())
+
+	intervals := pattern.Intervals(service.ServiceOrder)
+	assert.NotEmpty(t, intervals)
+	crashes := 0
+	for i, interval := range intervals {
+		assert.LessOrEqual(t, interval.Start, interval.End)
+		assert.Less(t, interval.Start, 1000)
+		if i > 0 {
+			assert.Greater(t, interval.Start, intervals[i-1].End)
+		}
+		if interval.FailureType == service.FailureCrash {
+			crashes++
+		}
+	}
+	// both failure types are generated
+	assert.Greater(t, crashes, 0)
+	assert.Less(t, crashes, len(intervals))
+
+	// the seed reproduces the intervals
+	same := newRandomPattern(7)
+	assert.Nil(t, same.Init())
+	assert.Equal(t, intervals, same.Intervals(service.ServiceOrder))
+	other := newRandomPattern(8)
+	assert.Nil(t, other.Init())
+	assert.NotEqual(t, intervals, other.Intervals(service.ServiceOrder))
+
+	pattern.MTBF = 0
+	assert.ErrorIs(t, pattern.Init(), simulation.ErrInvalidPattern)
+}
+
+func TestRandomPatternJSON(t *testing.T) {
+	data := `{"type": "random", "services": ["order"], "mtbf": 10, "mttr": 2, "seed": 3}`
+	pattern, err := simulation.DecodePattern([]byte(data))
+	assert.Nil(t, err)
+	random, ok := pattern.(*simulation.RandomPattern)
+	assert.True(t, ok)
+	assert.Equal(t, []string{service.ServiceOrder}, random.ServiceNames)
+	assert.Equal(t, 10.0, random.MTBF)
+	assert.Equal(t, int64(3), *random.Seed)
+}
+
+func TestSimulateRandomPattern(t *testing.T) {
+	simulate := func(seed int) (string, *simulation.RoundSimulator) {
+		pattern := simulation.NewRandomPattern()
+		pattern.MTBF = 5
+		out := &bytes.Buffer{}
+		simulator := simulation.NewRoundSimultor()
+		simConf := simulation.NewSimulationConfig()
+		simConf.Pattern = &pattern
+		simConf.Seed = seed
+		simConf.Rounds = 60
+		simConf.Output = out
+		err := simulator.Simulate(*simConf)
+		assert.Nil(t, err)
+		return out.String(), simulator
+	}
+
+	// the seed of the simulation fully reproduces the run
+	out1, simulator := simulate(11)
+	out2, _ := simulate(11)
+	out3, _ := simulate(12)
+	assert.Equal(t, out1, out2)
+	assert.NotEqual(t, out1, out3)
+
+	pattern := simulator.SimConf.Pattern.(*simulation.RandomPattern)
+	assert.Equal(t, int64(11), *pattern.Seed)
+	assert.Equal(t, simulator.Sys.ServiceNames(), pattern.ServiceNames)
+}
+
+func TestRandomPatternDefaults(t *testing.T) {
+	data := `{"type": "random", "services": ["order"], "rounds": 1000, "seed": 0}`
+	pattern, err := simulation.DecodePattern([]byte(data))
+	assert.Nil(t, err)
+	random := pattern.(*simulation.RandomPattern)
+
+	// the explicit seed 0 is kept instead of the seed of the simulation
+	random.Prepare([]string{service.ServiceShipping}, 20, 42)
+	assert.Equal(t, int64(0), *random.Seed)
+	assert.Equal(t, 1000, *random.Rounds)
+	assert.Equal(t, []string{service.ServiceOrder}, random.ServiceNames)
+
+	// the link failures are generated by default
+	assert.Nil(t, random.Init())
+	links := 0
+	for _, interval := range random.Intervals(service.ServiceOrder) {
+		if interval.FailureType == service.FailureLinkBroken {
+			links++
+		}
+	}
+	assert.Greater(t, links, 0)
+
+	// the simulation seed 0 is used as well
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	unset := simulation.NewRandomPattern()
+	simConf.Pattern = &unset
+	simConf.Seed = 0
+	simConf.Output = io.Discard
+	assert.Nil(t, simulator.Simulate(*simConf))
+	assert.Equal(t, int64(0), *unset.Seed)
+	assert.Equal(t, simulation.DefaultRounds, *unset.Rounds)
+}
@@ -2,6 +2,9 @@ package simulation
 
 import (
 	"atm/service"
+	"fmt"
+	"io"
+	"path/filepath"
 )
 
 const (
@@ -10,8 +13,8 @@ const (
 )
 
 type Request struct {
-	Req       service.Request
-	Timestamp int
+	Req       service.Request `json:"request"`
+	Timestamp int             `json:"timestamp"`
 }
 
 func NewInitRequest() []Request {
@@ -44,11 +47,39 @@ func NewInitRequest() []Request {
 type SimulationConfig struct {
 	Pattern FailurePattern `json:"pattern"`
 	Rounds  int            `json:"rounds"`
-	Seed    int            `json:"seed"`
+	// the seed of the random source, 0 is a valid seed
+	Seed int `json:"seed"`
+	// the probability that an event is sent twice
+	DuplicateRate float64 `json:"duplicate_rate"`
+	DisableDedup  bool    `json:"disable_dedup"`
+	// the outcome when a stage meets a record locked by another transaction
+	ConflictPolicy service.ConflictPolicy `json:"conflict_policy"`
+	// the rollback mode of the requests which do not choose one, default to concurrent
+	RollbackMode service.RollbackMode `json:"rollback_mode"`
+	// the requests sent to the gateway, default to NewInitRequest()
+	Requests []Request `json:"requests"`
+	// the services built from the definition replace the built-in ones with the same names
+	Saga *service.SagaDefinition `json:"saga"`
+	// the number of instances and queue partitions of each service, default to 1.
+	// The instances only own partitions and leases, the service handles the events of all of them.
+	Instances  map[string]int `json:"instances"`
+	Partitions map[string]int `json:"partitions"`
+	// the number of replicas of the tx manager, 3 or 5 tolerate the crash of a minority, default to a single node
+	TxManagerReplicas int `json:"tx_manager_replicas"`
+	// the latency, loss and reordering of the links, the default profile applies to the links not listed
+	LinkProfile service.LinkProfile  `json:"link_profile"`
+	Links       []service.LinkConfig `json:"link_profiles"`
+	// the directory of the durable event queue, the queue is kept in memory if empty
+	LogDir string `json:"log_dir"`
+	// the writer of the event log, default to stdout
+	Output io.Writer `json:"-"`
 }
 
 func NewSimulationConfig() *SimulationConfig {
-	return &SimulationConfig{}
+	return &SimulationConfig{
+		Rounds: DefaultRounds,
+		Seed:   DefaultSeed,
+	}
 }
 
 type Simulator interface {
@@ -58,6 +89,15 @@ type Simulator interface {
 type RoundSimulator struct {
 	Sys     *service.System
 	SimConf SimulationConfig
+	// the decided transactions of the tx manager before it crashed, and the term of the crashed leader
+	decided    map[string]service.TxStatus
+	term       int
+	recoveries int
+	// the decided transactions the tx manager forgot after restart
+	recoveryErrs []error
+	// the rounds run and the rounds in which the tx manager was unavailable
+	rounds      int
+	unavailable int
 }
 
 func NewRoundSimultor() *RoundSimulator {
@@ -72,7 +112,7 @@ func (rs *RoundSimulator) Simulate(simConf SimulationConfig) error {
 	}
 
 	gtw := rs.Sys.Gateway
-	for _, req := range NewInitRequest() {
+	for _, req := range rs.SimConf.Requests {
 		gtw.Send(req.Req, req.Timestamp)
 	}
 
@@ -85,46 +125,173 @@ func (rs *RoundSimulator) Simulate(simConf SimulationConfig) error {
 	return nil
 }
 
+// Close releases the files of the durable event queue and the journal of the tx manager
+func (rs *RoundSimulator) Close() error {
+	if rs.Sys == nil {
+		return nil
+	}
+	if err := rs.Sys.TxManager().Close(); err != nil {
+		return err
+	}
+	return rs.Sys.EventQueue.Close()
+}
+
+// Availability returns the fraction of the rounds in which the tx manager could handle the events
+func (rs *RoundSimulator) Availability() float64 {
+	if rs.rounds == 0 {
+		return 0
+	}
+	return 1 - float64(rs.unavailable)/float64(rs.rounds)
+}
+
+// Step runs one more round after the simulation
+func (rs *RoundSimulator) Step() error {
+	return rs.run()
+}
+
 func (rs *RoundSimulator) init(sys *service.System, simConf SimulationConfig) error {
-	// TODO:
-	// if err := simConf.Pattern.Init(); err != nil {
-	// 	return err
-	// }
+	if simConf.Pattern == nil {
+		pattern := NewDefinedIntervalPattern()
+		simConf.Pattern = &pattern
+	}
+	if simConf.Requests == nil {
+		simConf.Requests = NewInitRequest()
+	}
 	if simConf.Rounds == 0 {
 		simConf.Rounds = DefaultRounds
 	}
-	if simConf.Seed == 0 {
-		simConf.Seed = 42
-	}
 
+	sys.Seed(int64(simConf.Seed))
+	sys.SetDuplicateRate(simConf.DuplicateRate)
+	sys.SetDeduplication(!simConf.DisableDedup)
+	sys.SetConflictPolicy(simConf.ConflictPolicy)
+	if simConf.RollbackMode != service.RollbackDefault {
+		sys.SetRollbackMode(simConf.RollbackMode)
+	}
+	if simConf.Output != nil {
+		sys.Report().SetWriter(simConf.Output)
+	}
+	if simConf.Saga != nil {
+		if err := sys.Define(*simConf.Saga); err != nil {
+			return err
+		}
+	}
+	if err := sys.SetDefaultLinkProfile(simConf.LinkProfile); err != nil {
+		return err
+	}
+	for _, link := range simConf.Links {
+		if err := sys.SetLinkProfile(link.From, link.To, link.LinkProfile); err != nil {
+			return err
+		}
+	}
+	if err := sys.SetTxManagerReplicas(simConf.TxManagerReplicas); err != nil {
+		return err
+	}
+	for srv, n := range simConf.Instances {
+		sys.SetInstances(srv, n)
+	}
+	for srv, n := range simConf.Partitions {
+		sys.EventQueue.SetPartitions(srv, n)
+	}
+	simConf.Pattern.Prepare(sys.ServiceNames(), simConf.Rounds, int64(simConf.Seed))
+	if err := simConf.Pattern.Init(); err != nil {
+		return err
+	}
+	if err := validateServices(sys, simConf.Pattern); err != nil {
+		return err
+	}
+	if err := validateLinks(sys, simConf.Links); err != nil {
+		return err
+	}
+	if simConf.LogDir != "" {
+		if err := sys.EventQueue.SetLogDir(simConf.LogDir); err != nil {
+			return err
+		}
+		// the replicas keep their journal in the replicated log
+		if tm, ok := sys.GetService(service.ServiceTxManager).(*service.TxManager); ok {
+			if err := tm.SetJournalDir(filepath.Join(simConf.LogDir, "journal")); err != nil {
+				return err
+			}
+		}
+	}
 	rs.Sys = sys
 	rs.SimConf = simConf
 	return nil
 }
 
+// validateServices checks that the pattern only fails the known components
+func validateServices(sys *service.System, pattern FailurePattern) error {
+	named, ok := pattern.(interface{ Services() []string })
+	if !ok {
+		return nil
+	}
+	return validateNames(sys, named.Services(), "the pattern")
+}
+
+// validateLinks checks that the link profiles only connect the known components
+func validateLinks(sys *service.System, links []service.LinkConfig) error {
+	names := []string{}
+	for _, link := range links {
+		names = append(names, link.From, link.To)
+	}
+	return validateNames(sys, names, "the link profiles")
+}
+
+func validateNames(sys *service.System, names []string, where string) error {
+	known := map[string]bool{}
+	for _, name := range sys.StatusNames() {
+		known[name] = true
+	}
+	for _, name := range names {
+		if !known[name] {
+			return fmt.Errorf("%w in %s: %s", service.ErrUnknownService, where, name)
+		}
+	}
+	return nil
+}
+
 func (rs *RoundSimulator) run() error {
-	// round := rs.Sys.Advance()
+	round := rs.Sys.Round()
 
 	// fmt.Printf("round: %d\n", rs.Sys.Round())
-	// for _, srv := range rs.Sys.Services {
-	// 	srvName := srv.Name()
-	// 	failureType, _ := rs.SimConf.Pattern.Get(srvName, round)
-	// 	rs.Sys.SetFailure(srvName, failureType)
-	// }
+	for _, srvName := range rs.Sys.StatusNames() {
+		failureType, _ := rs.SimConf.Pattern.Get(srvName, round)
+		crashed := rs.Sys.IsCrashed(srvName)
+		if rs.isLeader(srvName) && !crashed && failureType == service.FailureCrash {
+			rs.checkpoint()
+			rs.crashTxManager()
+		}
+		if err := rs.Sys.SetFailure(srvName, failureType); err != nil {
+			return err
+		}
+		if srvName == service.ServiceTxManager && crashed && failureType != service.FailureCrash {
+			restarted, err := rs.restartTxManager()
+			if err != nil {
+				return err
+			}
+			// a replicated tx manager is checked once its next leader is elected
+			if restarted {
+				rs.checkRecovery()
+			}
+		}
+	}
+	if lp, ok := rs.SimConf.Pattern.(LinkPattern); ok {
+		rs.Sys.SetPartitionedLinks(lp.PartitionedLinks(round))
+	}
 
 	rs.Sys.Gateway.Receive()
 
-	// var wg sync.WaitGroup
-	// for _, srv := range rs.Sys.Services {
-	// 	wg.Add(1)
-	// 	go func(srv service.Service) {
-	// 		defer wg.Done()
-	// 		srv.Receive()
-	// 	}(srv)
-	// }
-	// wg.Done()
-	for _, srv := range rs.Sys.Services {
-		srv.Receive()
+	// services are visited in a fixed order so that a simulation is reproducible
+	for _, srvName := range rs.Sys.ServiceNames() {
+		rs.Sys.GetService(srvName).Receive()
+	}
+	if rs.isElected() {
+		rs.checkRecovery()
+	}
+
+	rs.rounds++
+	if !rs.Sys.TxManagerAvailable() {
+		rs.unavailable++
 	}
 
 	rs.Sys.PrintResult()
@@ -132,3 +299,33 @@ func (rs *RoundSimulator) run() error {
 
 	return nil
 }
+
+// isLeader reports whether the component runs the tx manager or its leader replica
+func (rs *RoundSimulator) isLeader(srvName string) bool {
+	if srvName == service.ServiceTxManager {
+		return true
+	}
+	tm, ok := rs.Sys.GetService(service.ServiceTxManager).(*service.ReplicatedTxManager)
+	if !ok {
+		return false
+	}
+	leader := tm.Leader()
+	return leader != nil && leader.Name() == srvName
+}
+
+// crashTxManager loses the transactions kept in memory by the tx manager.
+// The replicas of a replicated tx manager notice their crashes by themselves.
+func (rs *RoundSimulator) crashTxManager() {
+	if tm, ok := rs.Sys.GetService(service.ServiceTxManager).(*service.TxManager); ok {
+		tm.Crash()
+	}
+}
+
+// restartTxManager rebuilds the transactions of the tx manager from its journal
+func (rs *RoundSimulator) restartTxManager() (bool, error) {
+	tm, ok := rs.Sys.GetService(service.ServiceTxManager).(*service.TxManager)
+	if !ok {
+		return false, nil
+	}
+	return true, tm.Restart()
+}
@@ -1,7 +1,14 @@
 package simulation_test
 
 import (
+	"atm/ds"
+	"atm/service"
 	"atm/simulation"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,6 +17,1573 @@ import (
 func TestSimulate(t *testing.T) {
 	simulator := simulation.NewRoundSimultor()
 	simConf := simulation.NewSimulationConfig()
-	simulator.Simulate(*simConf)
-	assert.True(t, true)
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	status, ok := simulator.Sys.Gateway.Query("tx-1")
+	assert.True(t, ok)
+	assert.Equal(t, service.StateComplete, status.State)
+	assert.Equal(t, service.PhaseEnd, status.Phase)
+	assert.Equal(t, 15, status.Round)
+
+	history := simulator.Sys.TxManager().History("tx-1")
+	assert.Equal(t, []service.Transition{
+		{From: service.StateNone, To: service.StateInProgress, Phase: service.PhaseBegin, Round: 1},
+		{From: service.StateInProgress, To: service.StateCommit, Phase: service.PhaseProcessing, Round: 9},
+		{From: service.StateCommit, To: service.StateComplete, Phase: service.PhaseEnd, Round: 15},
+	}, history)
+}
+
+func TestAbortAfterComplete(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	sys := simulator.Sys
+	e := service.NewEvent()
+	e.TxID = "tx-1"
+	e.From = service.ServicePayment
+	e.To = service.ServiceTxManager
+	e.Round = sys.Round()
+	e.Phase = service.PhaseProcessing
+	e.State = service.StateAbort
+	e.PushRollbackStack(service.ServiceOrder, "order", 0)
+	err = sys.EventQueue.Send(e)
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		err = simulator.Step()
+		assert.Nil(t, err)
+	}
+
+	// the illegal transition is rejected and nothing is compensated
+	status, _ := sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	assert.Equal(t, 0, status.RollbackSent)
+	assert.Equal(t, 3, len(sys.TxManager().History("tx-1")))
+}
+
+func TestSimulateServiceCrash(t *testing.T) {
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		service.ServicePayment: {
+			{
+				Start:       0,
+				End:         simulation.DefaultRounds,
+				FailureType: service.FailureCrash,
+			},
+		},
+	}
+
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the crashed payment service never pulls the event sent by the tx manager
+	eq := simulator.Sys.EventQueue
+	assert.Equal(t, 1, eq.Len(service.ServicePayment))
+	assert.Equal(t, 0, eq.Len(service.ServiceOrder))
+}
+
+func TestSimulateLinkBroken(t *testing.T) {
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		service.ServicePayment: {
+			{
+				Start:       0,
+				End:         simulation.DefaultRounds,
+				FailureType: service.FailureLinkBroken,
+			},
+		},
+	}
+
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the payment service pulls the event but the next one is still waiting for its retry
+	eq := simulator.Sys.EventQueue
+	assert.Equal(t, 0, eq.Len(service.ServicePayment))
+	assert.Equal(t, 0, eq.Len(service.ServiceOrder))
+}
+
+func TestSimulateRetry(t *testing.T) {
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		service.ServicePayment: {
+			{
+				Start:       2,
+				End:         5,
+				FailureType: service.FailureLinkBroken,
+			},
+		},
+	}
+
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	simConf.Rounds = 9
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the failed send at round 2 is retried at round 4 and round 8
+	eq := simulator.Sys.EventQueue
+	e, err := eq.Pull(service.ServiceOrder)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, e.Round)
+	assert.Equal(t, 2, e.CurrentRetryTime)
+	assert.Equal(t, service.DefaultRetryTime-2, e.RemainingRetryTime)
+}
+
+func simulateRollback(t *testing.T, mode service.RollbackMode) []service.StageCount {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Rounds = 1
+	simConf.Requests = []simulation.Request{}
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	sys := simulator.Sys
+	e := service.NewEvent()
+	e.TxID = "tx-abort"
+	e.From = service.ServicePayment
+	e.To = service.ServiceTxManager
+	e.Round = sys.Round()
+	e.Phase = service.PhaseProcessing
+	e.State = service.StateAbort
+	e.RollbackMode = mode
+	e.PushRollbackStack(service.ServiceOrder, "order", 0)
+	e.PushRollbackStack(service.ServiceShipping, "shipping", 0)
+	e.PushRollbackStack(service.ServiceCustomer, "customer", 0)
+	err = sys.EventQueue.Send(e)
+	assert.Nil(t, err)
+
+	for i := 0; i < 8; i++ {
+		err = simulator.Step()
+		assert.Nil(t, err)
+	}
+	return sys.Report().Stages()
+}
+
+// assertStages checks the stages receiving one event each, in order of round and stage
+func assertStages(t *testing.T, expected []service.StageCount, stages []service.StageCount) {
+	assert.Equal(t, len(expected), len(stages))
+	for i := range expected {
+		if i >= len(stages) {
+			break
+		}
+		assert.Equal(t, expected[i].Round, stages[i].Round)
+		assert.Equal(t, expected[i].Stage, stages[i].Stage)
+		assert.Equal(t, 1, stages[i].Events)
+	}
+}
+
+func TestSimulateConcurrentRollback(t *testing.T) {
+	stages := simulateRollback(t, service.RollbackConcurrent)
+	// all compensations are sent in the same round
+	assertStages(t, []service.StageCount{
+		{Round: 1, Stage: "tx_manager||0"},
+		{Round: 2, Stage: "customer|customer|0"},
+		{Round: 2, Stage: "order|order|0"},
+		{Round: 2, Stage: "shipping|shipping|0"},
+		{Round: 3, Stage: "tx_manager|customer|0"},
+		{Round: 3, Stage: "tx_manager|order|0"},
+		{Round: 3, Stage: "tx_manager|shipping|0"},
+	}, stages)
+}
+
+func TestSimulateHierarchicalRollback(t *testing.T) {
+	stages := simulateRollback(t, service.RollbackHierarchical)
+	assert.Equal(t, 7, len(stages))
+	// the compensations are sent one by one after each acknowledgement
+	expected := []string{
+		"tx_manager||0",
+		"customer|customer|0",
+		"tx_manager|customer|0",
+		"shipping|shipping|0",
+		"tx_manager|shipping|0",
+		"order|order|0",
+		"tx_manager|order|0",
+	}
+	for i, stage := range stages {
+		assert.Equal(t, expected[i], stage.Stage)
+		assert.Equal(t, 1, stage.Events)
+	}
+}
+
+func TestQueryStatus(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Rounds = 5
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	gtw := simulator.Sys.Gateway
+	_, ok := gtw.Query("tx-unknown")
+	assert.False(t, ok)
+
+	// the saga is still running in the services
+	all := gtw.QueryAll()
+	assert.Equal(t, 1, len(all))
+	assert.Equal(t, service.StateInProgress, all[0].State)
+	assert.Equal(t, service.PhaseBegin, all[0].Phase)
+	assert.Equal(t, 1, all[0].Round)
+	assert.Equal(t, all, gtw.QueryByState(service.StateInProgress))
+	// the running transaction has not reached its deadline yet
+	assert.Empty(t, simulator.Verify())
+}
+
+func TestSimulateBasicPattern(t *testing.T) {
+	pattern, err := simulation.NamedPattern("basic")
+	assert.Nil(t, err)
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = pattern
+	simConf.Output = io.Discard
+	err = simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the failures of the gateway and the customer service delay the transaction
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	assert.Greater(t, status.Round, 15)
+	assert.Empty(t, simulator.Verify())
+}
+
+func TestSimulateAbort(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = []simulation.Request{
+		{
+			Timestamp: 0,
+			Req: service.Request{
+				Service:  service.ServicePayment,
+				Endpoint: "payment_control",
+				Body: map[string]interface{}{
+					"Abort": true,
+				},
+			},
+		},
+	}
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the control endpoint aborts instead of committing
+	stages := simulator.Sys.Report().Stages()
+	assert.Equal(t, 15, len(stages))
+	// the order, shipping and customer stages are compensated concurrently
+	assertStages(t, []service.StageCount{
+		{Round: 9, Stage: "tx_manager||0"},
+		{Round: 10, Stage: "customer|customer|0"},
+		{Round: 10, Stage: "order|order|0"},
+		{Round: 10, Stage: "shipping|shipping|0"},
+		{Round: 11, Stage: "tx_manager|customer|0"},
+		{Round: 11, Stage: "tx_manager|order|0"},
+		{Round: 11, Stage: "tx_manager|shipping|0"},
+	}, stages[8:])
+
+	gtw := simulator.Sys.Gateway
+	assert.Empty(t, gtw.QueryByState(service.StateComplete))
+	aborted := gtw.QueryByState(service.StateAborted)
+	assert.Equal(t, 1, len(aborted))
+	assert.Equal(t, "tx-1", aborted[0].TxID)
+	assert.Equal(t, service.PhaseRollback, aborted[0].Phase)
+	assert.Equal(t, 3, aborted[0].RollbackSent)
+	assert.Equal(t, 3, aborted[0].RollbackAcked)
+
+	history := simulator.Sys.TxManager().History("tx-1")
+	assert.Equal(t, 3, len(history))
+	assert.Equal(t, service.StateAbort, history[1].To)
+	assert.Equal(t, service.StateAborted, history[2].To)
+	assert.Equal(t, 11, history[2].Round)
+}
+
+func TestSimulateAbortHierarchically(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = []simulation.Request{
+		{
+			Timestamp: 0,
+			Req: service.Request{
+				Service:      service.ServicePayment,
+				Endpoint:     "payment_control",
+				RollbackMode: service.RollbackHierarchical,
+				Body: map[string]interface{}{
+					"Abort": true,
+				},
+			},
+		},
+	}
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the dispatchers push the compensable stages in the order they succeed
+	expected := []string{
+		"customer|customer|0",
+		"tx_manager|customer|0",
+		"shipping|shipping|0",
+		"tx_manager|shipping|0",
+		"order|order|0",
+		"tx_manager|order|0",
+	}
+	stages := simulator.Sys.Report().Stages()
+	assert.Equal(t, 9+len(expected), len(stages))
+	for i, stage := range stages[9:] {
+		assert.Equal(t, expected[i], stage.Stage)
+	}
+
+	status, ok := simulator.Sys.Gateway.Query("tx-1")
+	assert.True(t, ok)
+	assert.Equal(t, service.StateAborted, status.State)
+	assert.Equal(t, 3, status.RollbackAcked)
+}
+
+func TestIdempotentBegin(t *testing.T) {
+	req := service.Request{
+		Service:        service.ServicePayment,
+		Endpoint:       "payment_control",
+		IdempotencyKey: "client-retry",
+	}
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = []simulation.Request{
+		{Timestamp: 0, Req: req},
+		{Timestamp: 3, Req: req},
+	}
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the retry of the client does not spawn another transaction
+	all := simulator.Sys.Gateway.QueryAll()
+	assert.Equal(t, 1, len(all))
+	assert.Equal(t, service.StateComplete, all[0].State)
+}
+
+func TestDuplicateBegin(t *testing.T) {
+	req := service.Request{
+		TxID:     "tx-dup",
+		Service:  service.ServicePayment,
+		Endpoint: "payment_control",
+	}
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = []simulation.Request{
+		{Timestamp: 0, Req: req},
+		{Timestamp: 3, Req: req},
+	}
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the second begin is ignored by the tx manager
+	status, ok := simulator.Sys.Gateway.Query("tx-dup")
+	assert.True(t, ok)
+	assert.Equal(t, service.StateComplete, status.State)
+	assert.Equal(t, 15, status.Round)
+	assert.Equal(t, 1, simulator.Sys.Report().Duplicates()["tx_manager||0"])
+}
+
+func TestExpireInService(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = []simulation.Request{
+		{
+			Timestamp: 0,
+			Req: service.Request{
+				Service:  service.ServicePayment,
+				Endpoint: "payment_control",
+				TTL:      4,
+			},
+		},
+	}
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the order service finds the event expired after the shipping stage
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateAborted, status.State)
+	assert.Equal(t, 5, status.Deadline)
+	assert.Equal(t, 2, status.RollbackSent)
+	assert.Equal(t, 2, status.RollbackAcked)
+}
+
+func TestExpireInTxManager(t *testing.T) {
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		service.ServiceShipping: {
+			{
+				Start:       0,
+				End:         12,
+				FailureType: service.FailureCrash,
+			},
+		},
+	}
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	simConf.Requests = []simulation.Request{
+		{
+			Timestamp: 0,
+			Req: service.Request{
+				Service:  service.ServicePayment,
+				Endpoint: "payment_control",
+				TTL:      5,
+			},
+		},
+	}
+	simConf.Rounds = 10
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the hung transaction is aborted by the tx manager
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateAborted, status.State)
+	assert.Equal(t, 0, status.RollbackSent)
+
+	// the order stage is compensated after the shipping service recovers
+	for i := 0; i < 7; i++ {
+		err = simulator.Step()
+		assert.Nil(t, err)
+	}
+	status, _ = simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateAborted, status.State)
+	assert.Equal(t, 1, status.RollbackSent)
+	assert.Equal(t, 1, status.RollbackAcked)
+}
+
+func TestExpireAfterCommit(t *testing.T) {
+	for _, ttl := range []int{8, 10, 12} {
+		simulator := simulation.NewRoundSimultor()
+		simConf := simulation.NewSimulationConfig()
+		simConf.Requests = []simulation.Request{
+			{
+				Timestamp: 0,
+				Req: service.Request{
+					Service:  service.ServicePayment,
+					Endpoint: "payment_control",
+					TTL:      ttl,
+					Body: map[string]interface{}{
+						"OrderID": "order-1",
+					},
+				},
+			},
+		}
+		simConf.Rounds = 40
+		simConf.Output = io.Discard
+		err := simulator.Simulate(*simConf)
+		assert.Nil(t, err)
+
+		// the deadline passes between the commit and the completion, the committed saga still completes
+		status, _ := simulator.Sys.Gateway.Query("tx-1")
+		assert.Equal(t, service.StateComplete, status.State, "ttl %d", ttl)
+		assert.Empty(t, simulator.Verify(), "ttl %d", ttl)
+	}
+}
+
+func TestForwardLostAfterCommit(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = []simulation.Request{
+		{
+			Timestamp: 0,
+			Req: service.Request{
+				Service:  service.ServicePayment,
+				Endpoint: "payment_control",
+				TTL:      15,
+			},
+		},
+	}
+	simConf.Rounds = 9
+	simConf.Output = io.Discard
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the event sent after the commit is lost with the release of the payment records
+	sys := simulator.Sys
+	assert.Nil(t, sys.SetLinkProfile(service.ServiceTxManager, service.ServicePayment, service.LinkProfile{DropRate: 1}))
+	assert.Nil(t, simulator.Step())
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateCommit, status.State)
+	phases := []service.Phase{}
+	for _, e := range sys.EventQueue.Dropped() {
+		phases = append(phases, e.Phase)
+	}
+	assert.ElementsMatch(t, []service.Phase{service.PhaseProcessing, service.PhaseRelease}, phases)
+	assert.Nil(t, sys.SetLinkProfile(service.ServiceTxManager, service.ServicePayment, service.LinkProfile{}))
+
+	// the tx manager sends it again after the deadline and the transaction completes
+	for i := 0; i < 15; i++ {
+		assert.Nil(t, simulator.Step())
+	}
+	status, _ = simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	assert.Greater(t, status.Round, status.Deadline)
+	assert.Empty(t, simulator.Verify())
+}
+
+func newChargeRequests(body map[string]interface{}) []simulation.Request {
+	reqs := []simulation.Request{}
+	for _, amount := range []int{10, 20} {
+		b := map[string]interface{}{
+			"CustomerID": "customer-123",
+			"Amount":     amount,
+		}
+		for k, v := range body {
+			b[k] = v
+		}
+		reqs = append(reqs, simulation.Request{
+			Timestamp: 0,
+			Req: service.Request{
+				Service:  service.ServicePayment,
+				Endpoint: "payment_control",
+				Body:     b,
+			},
+		})
+	}
+	return reqs
+}
+
+func TestSemanticLockWait(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = newChargeRequests(nil)
+	simConf.Rounds = 30
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the second saga waits until the first one commits
+	gtw := simulator.Sys.Gateway
+	assert.Equal(t, 2, len(gtw.QueryByState(service.StateComplete)))
+	status1, _ := gtw.Query("tx-1")
+	status2, _ := gtw.Query("tx-2")
+	assert.Less(t, status1.Round, status2.Round)
+
+	store := simulator.Sys.Store(service.ServiceCustomer)
+	record, ok := store.Record("customer-123")
+	assert.True(t, ok)
+	assert.Equal(t, 30, record.Value)
+	assert.Equal(t, service.RecordCommitted, record.State)
+}
+
+func TestSemanticLockWaitExpires(t *testing.T) {
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		service.ServiceOrder: {
+			{
+				Start:       6,
+				End:         60,
+				FailureType: service.FailureCrash,
+			},
+		},
+	}
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	simConf.Requests = newChargeRequests(nil)
+	for i := range simConf.Requests {
+		simConf.Requests[i].Req.TTL = 10
+	}
+	simConf.Rounds = 30
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the first saga hangs with the lock, the second one waits only until its deadline
+	status, _ := simulator.Sys.Gateway.Query("tx-2")
+	assert.Equal(t, service.StateAborted, status.State)
+	assert.Less(t, status.Round, 30)
+}
+
+func TestSemanticLockAbort(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = newChargeRequests(nil)
+	simConf.ConflictPolicy = service.ConflictAbort
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the second saga is aborted instead of overwriting the pending record
+	gtw := simulator.Sys.Gateway
+	status1, _ := gtw.Query("tx-1")
+	status2, _ := gtw.Query("tx-2")
+	assert.Equal(t, service.StateComplete, status1.State)
+	assert.Equal(t, service.StateAborted, status2.State)
+
+	balance, _ := simulator.Sys.Store(service.ServiceCustomer).Get("customer-123")
+	assert.Equal(t, 10, balance)
+}
+
+func TestSemanticLockRetry(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = newChargeRequests(nil)
+	simConf.ConflictPolicy = service.ConflictRetry
+	simConf.Rounds = 40
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the second saga backs off until the first one releases the record
+	gtw := simulator.Sys.Gateway
+	assert.Equal(t, 2, len(gtw.QueryByState(service.StateComplete)))
+	status1, _ := gtw.Query("tx-1")
+	status2, _ := gtw.Query("tx-2")
+	assert.Less(t, status1.Round, status2.Round)
+
+	record, ok := simulator.Sys.Store(service.ServiceCustomer).Record("customer-123")
+	assert.True(t, ok)
+	assert.Equal(t, 30, record.Value)
+	assert.Equal(t, service.RecordCommitted, record.State)
+	assert.Empty(t, simulator.Verify())
+}
+
+func TestSemanticLockReleasePartitioned(t *testing.T) {
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.Links = []simulation.LinkInterval{{
+		Link:  service.Link{From: service.ServiceTxManager, To: service.ServiceOrder},
+		Start: 0,
+		End:   20,
+	}}
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	simConf.Rounds = 18
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the release does not reach the order service through the partition
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	store := simulator.Sys.Store(service.ServiceOrder)
+	assert.Equal(t, []string{"order-1"}, store.Locked("tx-1"))
+
+	// the tx manager retries the release after the link heals
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, simulator.Step())
+	}
+	assert.Empty(t, store.Locked("tx-1"))
+	assert.Empty(t, simulator.Verify())
+}
+
+func TestSemanticLockCompensation(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = newChargeRequests(map[string]interface{}{
+		"Abort": true,
+	})
+	simConf.Rounds = 30
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// both sagas restore the record and release the lock
+	gtw := simulator.Sys.Gateway
+	assert.Equal(t, 2, len(gtw.QueryByState(service.StateAborted)))
+	store := simulator.Sys.Store(service.ServiceCustomer)
+	_, ok := store.Get("customer-123")
+	assert.False(t, ok)
+	assert.Empty(t, store.Locked("tx-1"))
+	assert.Empty(t, store.Locked("tx-2"))
+}
+
+func TestStoreCommit(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the writes of the stages are committed when the transaction completes
+	sys := simulator.Sys
+	for srv, value := range map[string]string{
+		service.ServiceOrder:    "created",
+		service.ServiceShipping: "scheduled",
+		service.ServicePayment:  "paid",
+	} {
+		record, ok := sys.Store(srv).Record("order-1")
+		assert.True(t, ok)
+		assert.Equal(t, value, record.Value)
+		assert.Equal(t, service.RecordCommitted, record.State)
+	}
+}
+
+func TestStoreAbort(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = []simulation.Request{
+		{
+			Timestamp: 0,
+			Req: service.Request{
+				Service:  service.ServicePayment,
+				Endpoint: "payment_control",
+				Body: map[string]interface{}{
+					"OrderID": "order-1",
+					"Abort":   true,
+				},
+			},
+		},
+	}
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the compensations undo the writes of the order and shipping stages
+	sys := simulator.Sys
+	for _, srv := range []string{service.ServiceOrder, service.ServiceShipping, service.ServicePayment} {
+		_, ok := sys.Store(srv).Get("order-1")
+		assert.False(t, ok)
+		assert.Empty(t, sys.Store(srv).Locked("tx-1"))
+	}
+}
+
+func TestStoreDuplicate(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = newChargeRequests(nil)[:1]
+	simConf.DuplicateRate = 1
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the duplicated event is absorbed by the outbox in the same local transaction
+	balance, _ := simulator.Sys.Store(service.ServiceCustomer).Get("customer-123")
+	assert.Equal(t, 10, balance)
+	assert.NotZero(t, simulator.Sys.Report().Duplicates()["customer|customer|0"])
+}
+
+func simulateEventQueueCrash(t *testing.T, logDir string) *simulation.RoundSimulator {
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		service.ServiceEventQueue: {
+			{
+				Start:       4,
+				End:         5,
+				FailureType: service.FailureCrash,
+			},
+		},
+	}
+
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	simConf.Rounds = 30
+	simConf.LogDir = logDir
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+	return simulator
+}
+
+func TestEventQueueCrash(t *testing.T) {
+	simulator := simulateEventQueueCrash(t, "")
+
+	// the events kept in memory are lost with the crash
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateInProgress, status.State)
+}
+
+func TestDurableEventQueueCrash(t *testing.T) {
+	simulator := simulateEventQueueCrash(t, t.TempDir())
+	defer simulator.Close()
+
+	// the events are replayed from the log after the restart
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	for _, srv := range simulator.Sys.ServiceNames() {
+		assert.Equal(t, 0, simulator.Sys.EventQueue.Len(srv))
+	}
+}
+
+func TestCrashAfterPull(t *testing.T) {
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		service.ServiceOrder: {
+			{
+				Start:       3,
+				End:         3,
+				FailureType: service.FailureCrashAfterPull,
+			},
+		},
+	}
+
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	simConf.Rounds = 4
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the event pulled by the crashed service is invisible until its lease expires
+	eq := simulator.Sys.EventQueue
+	assert.Equal(t, 1, eq.Leased(service.ServiceOrder))
+	assert.Equal(t, 0, eq.Len(service.ServiceOrder))
+	for i := 1; i < service.DefaultVisibilityTimeout; i++ {
+		simulator.Step()
+		assert.Equal(t, 1, eq.Leased(service.ServiceOrder))
+	}
+
+	// then it is delivered again and acknowledged after the next event is sent
+	simulator.Step()
+	assert.Equal(t, 0, eq.Leased(service.ServiceOrder))
+	for i := 0; i < 20; i++ {
+		simulator.Step()
+	}
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	for _, srv := range simulator.Sys.ServiceNames() {
+		assert.Equal(t, 0, eq.Leased(srv))
+	}
+}
+
+func simulateInstances(t *testing.T, crashed ...string) *simulation.RoundSimulator {
+	pattern := simulation.NewDefinedIntervalPattern()
+	for _, instance := range crashed {
+		pattern.IntervalMap[instance] = []simulation.Interval{
+			{
+				Start:       2,
+				End:         30,
+				FailureType: service.FailureCrash,
+			},
+		}
+	}
+
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	simConf.Rounds = 30
+	simConf.Instances = map[string]int{service.ServiceOrder: 2}
+	simConf.Partitions = map[string]int{service.ServiceOrder: 4}
+	simConf.Requests = []simulation.Request{}
+	for i := 0; i < 4; i++ {
+		simConf.Requests = append(simConf.Requests, simulation.Request{
+			Timestamp: 0,
+			Req: service.Request{
+				Service:  service.ServicePayment,
+				Endpoint: "payment_control",
+				Body: map[string]interface{}{
+					"OrderID": fmt.Sprintf("order-%d", i),
+				},
+			},
+		})
+	}
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+	return simulator
+}
+
+func TestInstanceCrash(t *testing.T) {
+	simulator := simulateInstances(t, service.InstanceName(service.ServiceOrder, 1))
+
+	// the partitions of the crashed instance are taken over by the other one
+	eq := simulator.Sys.EventQueue
+	assert.Equal(t, 1, eq.Rebalances(service.ServiceOrder))
+	for p := 0; p < eq.Partitions(service.ServiceOrder); p++ {
+		assert.Equal(t, "order-0", eq.Owners(service.ServiceOrder)[p])
+	}
+	assert.Equal(t, 4, len(simulator.Sys.Gateway.QueryByState(service.StateComplete)))
+}
+
+func TestInstanceCrashAfterPull(t *testing.T) {
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		service.InstanceName(service.ServiceOrder, 0): {
+			{Start: 3, End: 3, FailureType: service.FailureCrashAfterPull},
+			{Start: 4, End: 40, FailureType: service.FailureCrash},
+		},
+	}
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	simConf.Instances = map[string]int{service.ServiceOrder: 2}
+	simConf.Partitions = map[string]int{service.ServiceOrder: 2}
+	simConf.Requests = []simulation.Request{}
+	for i := 0; i < 4; i++ {
+		simConf.Requests = append(simConf.Requests, simulation.Request{
+			Timestamp: 0,
+			Req: service.Request{
+				Service:  service.ServicePayment,
+				Endpoint: "payment_control",
+				Body: map[string]interface{}{
+					"OrderID": fmt.Sprintf("order-%d", i),
+				},
+			},
+		})
+	}
+	simConf.Rounds = 4
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the crashed instance leaves the event it pulled leased
+	eq := simulator.Sys.EventQueue
+	assert.Equal(t, 1, eq.Leased(service.ServiceOrder))
+
+	// it is delivered to the other instance after its lease expires
+	for i := 0; i < 36; i++ {
+		assert.Nil(t, simulator.Step())
+	}
+	for p := 0; p < eq.Partitions(service.ServiceOrder); p++ {
+		assert.Equal(t, "order-1", eq.Owners(service.ServiceOrder)[p])
+	}
+	assert.Zero(t, eq.Leased(service.ServiceOrder))
+	assert.Equal(t, 4, len(simulator.Sys.Gateway.QueryByState(service.StateComplete)))
+	assert.Empty(t, simulator.Verify())
+}
+
+func TestAllInstancesCrash(t *testing.T) {
+	simulator := simulateInstances(t,
+		service.InstanceName(service.ServiceOrder, 0),
+		service.InstanceName(service.ServiceOrder, 1),
+	)
+
+	// nobody consumes the partitions of the service
+	eq := simulator.Sys.EventQueue
+	assert.Empty(t, eq.Owners(service.ServiceOrder))
+	assert.Equal(t, 4, eq.Len(service.ServiceOrder))
+	assert.Empty(t, simulator.Sys.Gateway.QueryByState(service.StateComplete))
+}
+
+func newInventoryRequest() []simulation.Request {
+	return []simulation.Request{
+		{
+			Timestamp: 0,
+			Req: service.Request{
+				Service:  "inventory",
+				Endpoint: "inventory",
+			},
+		},
+	}
+}
+
+type InventoryService struct {
+	sys        *service.System
+	dispatcher *service.EventDispatcher
+}
+
+func NewInventoryService(sys *service.System) *InventoryService {
+	dispatcher := service.NewEventDispatcher(sys.EventQueue, "inventory")
+	dispatcher.Focus("inventory").
+		Add(func(e service.Event) (service.Event, error) {
+			e.End()
+			return e, nil
+		})
+	return &InventoryService{
+		sys:        sys,
+		dispatcher: dispatcher,
+	}
+}
+
+func (is *InventoryService) Name() string {
+	return "inventory"
+}
+
+func (is *InventoryService) Receive() {
+	for {
+		e, err := is.sys.EventQueue.Pull("inventory")
+		if err != nil {
+			break
+		}
+		is.dispatcher.Dispatch(e)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = newInventoryRequest()
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the event sent to the unknown service is dropped without retries
+	// and the transaction is aborted before its deadline
+	deadLetters := simulator.Sys.EventQueue.DeadLetters()
+	assert.Equal(t, 1, len(deadLetters))
+	assert.Equal(t, "inventory", deadLetters[0].Event.To)
+	assert.Equal(t, service.ErrUnknownService, deadLetters[0].Cause)
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateAborted, status.State)
+	assert.Less(t, status.Round, deadLetters[0].Event.Deadline)
+}
+
+func TestRegisterService(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = newInventoryRequest()
+	simConf.Rounds = 1
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	sys := simulator.Sys
+	sys.Register(NewInventoryService(sys))
+	assert.Contains(t, sys.ServiceNames(), "inventory")
+	assert.Contains(t, sys.StatusNames(), "inventory")
+	for i := 0; i < 5; i++ {
+		simulator.Step()
+	}
+
+	status, _ := sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	assert.Empty(t, sys.EventQueue.DeadLetters())
+}
+
+func TestSagaDefinition(t *testing.T) {
+	def, err := service.LoadSagaDefinition("../config/saga.json")
+	assert.Nil(t, err)
+
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Saga = &def
+	err = simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the defined services run the same saga as the built-in ones
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	assert.Equal(t, 15, status.Round)
+	_, ok := simulator.Sys.GetService(service.ServiceOrder).(*service.SagaService)
+	assert.True(t, ok)
+}
+
+func TestSagaDefinitionFail(t *testing.T) {
+	def, err := service.LoadSagaDefinition("../config/saga.json")
+	assert.Nil(t, err)
+	// the customer stage always fails
+	def.Services[3].Endpoints[0].Stages[0].Ops = []service.OpDefinition{
+		{Op: service.OpFail, Probability: 1},
+	}
+
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Saga = &def
+	err = simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the order and shipping stages are compensated
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateAborted, status.State)
+	assert.Equal(t, 2, status.RollbackSent)
+	assert.Equal(t, 2, status.RollbackAcked)
+}
+
+func TestInvalidSagaDefinition(t *testing.T) {
+	def := service.SagaDefinition{
+		Services: []service.ServiceDefinition{
+			{
+				Name: "inventory",
+				Endpoints: []service.EndpointDefinition{
+					{
+						Name: "inventory",
+						Stages: []service.StageDefinition{
+							{Ops: []service.OpDefinition{{Op: service.OpCall, Service: "order"}}},
+						},
+					},
+				},
+			},
+		},
+	}
+	assert.ErrorIs(t, def.Validate(), service.ErrInvalidDefinition)
+
+	def.Services[0].Endpoints[0].Stages[0].Ops[0] = service.OpDefinition{Op: "jump"}
+	assert.ErrorIs(t, def.Validate(), service.ErrInvalidDefinition)
+}
+
+func TestVerify(t *testing.T) {
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+	assert.Empty(t, simulator.Verify())
+
+	// the transactions cannot finish while every order instance is down, but they have not expired yet
+	simulator = simulateInstances(t,
+		service.InstanceName(service.ServiceOrder, 0),
+		service.InstanceName(service.ServiceOrder, 1),
+	)
+	assert.Empty(t, simulator.Verify())
+
+	// the expired transaction cannot release its record while the order service is down
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		service.ServiceOrder: {
+			{
+				Start:       4,
+				End:         60,
+				FailureType: service.FailureCrash,
+			},
+		},
+	}
+	simulator = simulation.NewRoundSimultor()
+	simConf = simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	simConf.Rounds = 30
+	simConf.Requests = simulation.NewInitRequest()
+	simConf.Requests[0].Req.TTL = 6
+	simConf.Output = io.Discard
+	err = simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+	errs := simulator.Verify()
+	assert.Equal(t, 1, len(errs))
+	assert.ErrorIs(t, errs[0], simulation.ErrInvariant)
+	assert.Contains(t, errs[0].Error(), "tx-1 leaves [order-1] locked in order")
+}
+
+func simulateLinks(t *testing.T, links ...simulation.LinkInterval) *simulation.RoundSimulator {
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.Links = links
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	simConf.Rounds = 60
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+	return simulator
+}
+
+func TestLinkPartition(t *testing.T) {
+	simulator := simulateLinks(t, simulation.LinkInterval{
+		Link:  service.Link{From: service.ServiceOrder, To: service.ServiceShipping},
+		Start: 0,
+		End:   60,
+	})
+
+	// the order service cannot reach shipping but still reports the abort to the tx manager
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateAborted, status.State)
+	history := simulator.Sys.TxManager().History("tx-1")
+	assert.Equal(t, service.StateAbort, history[1].To)
+	assert.Zero(t, simulator.Sys.Report().Duplicates()["shipping|shipping|0"])
+}
+
+func TestLinkTimeout(t *testing.T) {
+	simulator := simulateLinks(t, simulation.LinkInterval{
+		Link:  service.Link{From: service.ServiceShipping, To: service.ServiceOrder},
+		Start: 3,
+		End:   3,
+	})
+
+	// the event arrives once, the link heals before the visibility timeout
+	// so the order service neither sends it again nor aborts the transaction
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	assert.Equal(t, 15, status.Round)
+	assert.Zero(t, simulator.Sys.Report().Duplicates()["shipping|shipping|0"])
+	assert.Zero(t, simulator.Sys.EventQueue.Unacked(service.ServiceOrder))
+	assert.Empty(t, simulator.Sys.PartitionedLinks())
+}
+
+func simulateNetwork(t *testing.T, seed int, profile service.LinkProfile, links ...service.LinkConfig) (*simulation.RoundSimulator, string) {
+	return simulateNetworkRequests(t, seed, nil, profile, links...)
+}
+
+func simulateNetworkRequests(t *testing.T, seed int, reqs []simulation.Request, profile service.LinkProfile, links ...service.LinkConfig) (*simulation.RoundSimulator, string) {
+	out := &bytes.Buffer{}
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Seed = seed
+	simConf.Rounds = 80
+	simConf.Requests = reqs
+	simConf.LinkProfile = profile
+	simConf.Links = links
+	simConf.Output = out
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+	return simulator, out.String()
+}
+
+func TestLinkLatency(t *testing.T) {
+	simulator, _ := simulateNetwork(t, 0, service.LinkProfile{
+		Latency: service.Latency{Dist: service.LatencyFixed, Rounds: 2},
+	})
+
+	// each of the 15 hops takes 2 more rounds
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	assert.Equal(t, 45, status.Round)
+}
+
+func TestLinkLatencySeed(t *testing.T) {
+	profile := service.LinkProfile{
+		Latency: service.Latency{Dist: service.LatencyUniform, Min: 0, Max: 4},
+	}
+	_, out1 := simulateNetwork(t, 1, profile)
+	_, out2 := simulateNetwork(t, 1, profile)
+	_, out3 := simulateNetwork(t, 2, profile)
+	assert.Equal(t, out1, out2)
+	assert.NotEqual(t, out1, out3)
+
+	profile.Latency = service.Latency{Dist: service.LatencyExponential, Mean: 2}
+	simulator, _ := simulateNetwork(t, 1, profile)
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	assert.Greater(t, status.Round, 15)
+}
+
+func TestLinkDrop(t *testing.T) {
+	simulator, _ := simulateNetwork(t, 0, service.LinkProfile{}, service.LinkConfig{
+		Link:        service.Link{From: service.ServiceOrder, To: service.ServiceShipping},
+		LinkProfile: service.LinkProfile{DropRate: 1},
+	})
+
+	// the sender does not notice the loss, the transaction expires in the tx manager
+	dropped := simulator.Sys.EventQueue.Dropped()
+	assert.Equal(t, 1, len(dropped))
+	assert.Equal(t, service.ServiceShipping, dropped[0].To)
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateAborted, status.State)
+	assert.Empty(t, simulator.Verify())
+}
+
+func TestLinkDropBeforeDeadline(t *testing.T) {
+	pattern := simulation.NewDefinedIntervalPattern()
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	simConf.Rounds = 30
+	simConf.Links = []service.LinkConfig{{
+		Link:        service.Link{From: service.ServiceOrder, To: service.ServiceShipping},
+		LinkProfile: service.LinkProfile{DropRate: 1},
+	}}
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the simulation ends before the transaction which lost its event expires
+	errs := simulator.Verify()
+	assert.Equal(t, 1, len(errs))
+	assert.ErrorIs(t, errs[0], simulation.ErrInvariant)
+	assert.Contains(t, errs[0].Error(), "lost the event order -> shipping")
+}
+
+func TestLinkReorder(t *testing.T) {
+	reqs := []simulation.Request{}
+	for _, orderID := range []string{"order-1", "order-2"} {
+		reqs = append(reqs, simulation.Request{
+			Timestamp: 0,
+			Req: service.Request{
+				Service:  service.ServicePayment,
+				Endpoint: "payment_control",
+				Body: map[string]interface{}{
+					"OrderID":    orderID,
+					"CustomerID": "customer-123",
+				},
+			},
+		})
+	}
+	simulator, out := simulateNetworkRequests(t, 0, reqs, service.LinkProfile{}, service.LinkConfig{
+		Link:        service.Link{From: service.ServiceGateway, To: service.ServiceTxManager},
+		LinkProfile: service.LinkProfile{ReorderRate: 1},
+	})
+
+	// the second transaction overtakes the first one held on the link
+	begins := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "gateway -> [tx_manager") {
+			begins = append(begins, line)
+		}
+	}
+	assert.Equal(t, 2, len(begins))
+	assert.Contains(t, begins[0], "tx-2")
+	assert.Contains(t, begins[1], "tx-1")
+	for _, txid := range []string{"tx-1", "tx-2"} {
+		status, _ := simulator.Sys.Gateway.Query(txid)
+		assert.Equal(t, service.StateComplete, status.State)
+	}
+	assert.Zero(t, simulator.Sys.EventQueue.Held())
+}
+
+func TestLinkReorderWindow(t *testing.T) {
+	simulator, _ := simulateNetwork(t, 0, service.LinkProfile{}, service.LinkConfig{
+		Link:        service.Link{From: service.ServicePayment, To: service.ServiceTxManager},
+		LinkProfile: service.LinkProfile{ReorderRate: 1},
+	})
+
+	// no later event overtakes the commit, it is released after the reorder window
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	assert.Greater(t, status.Round, 15)
+	assert.Zero(t, simulator.Sys.EventQueue.Held())
+}
+
+func TestInvalidLinkProfile(t *testing.T) {
+	for _, profile := range []service.LinkProfile{
+		{Latency: service.Latency{Dist: "normal"}},
+		{Latency: service.Latency{Dist: service.LatencyUniform, Min: 3, Max: 1}},
+		{DropRate: 2},
+	} {
+		simConf := simulation.NewSimulationConfig()
+		simConf.LinkProfile = profile
+		err := simulation.NewRoundSimultor().Simulate(*simConf)
+		assert.ErrorIs(t, err, service.ErrInvalidLinkProfile)
+	}
+
+	simConf := simulation.NewSimulationConfig()
+	simConf.Links = []service.LinkConfig{{Link: service.Link{From: "warehouse", To: service.ServiceOrder}}}
+	err := simulation.NewRoundSimultor().Simulate(*simConf)
+	assert.ErrorIs(t, err, service.ErrUnknownService)
+}
+
+func simulateTxManagerCrash(t *testing.T, rounds int, logDir string) *simulation.RoundSimulator {
+	pattern := simulation.NewDefinedIntervalPattern()
+	pattern.IntervalMap = map[string][]simulation.Interval{
+		service.ServiceTxManager: {
+			{
+				Start:       10,
+				End:         12,
+				FailureType: service.FailureCrash,
+			},
+		},
+	}
+
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	simConf.Rounds = rounds
+	simConf.LogDir = logDir
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+	return simulator
+}
+
+func TestTxManagerRecovery(t *testing.T) {
+	simulator := simulateTxManagerCrash(t, 11, "")
+
+	// the committed transaction is rebuilt from the journal on restart
+	_, ok := simulator.Sys.Gateway.Query("tx-1")
+	assert.False(t, ok)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, simulator.Step())
+	}
+	status, ok := simulator.Sys.Gateway.Query("tx-1")
+	assert.True(t, ok)
+	assert.Equal(t, service.StateComplete, status.State)
+	history := simulator.Sys.TxManager().History("tx-1")
+	assert.Equal(t, 3, len(history))
+	assert.Equal(t, service.StateCommit, history[1].To)
+	assert.Empty(t, simulator.Verify())
+}
+
+// forgetfulLog loses its records once it is marked
+type forgetfulLog struct {
+	ds.Log
+	lost bool
+}
+
+func (fl *forgetfulLog) End() int {
+	if fl.lost {
+		return 0
+	}
+	return fl.Log.End()
+}
+
+func TestTxManagerForgets(t *testing.T) {
+	simulator := simulateTxManagerCrash(t, 10, "")
+	tm := simulator.Sys.TxManager()
+	journal := &forgetfulLog{Log: tm.Journal()}
+	assert.Nil(t, tm.SetJournal(journal))
+	journal.lost = true
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, simulator.Step())
+	}
+
+	errs := simulator.Verify()
+	assert.NotEmpty(t, errs)
+	assert.ErrorIs(t, errs[0], simulation.ErrInvariant)
+	assert.Contains(t, errs[0].Error(), "tx-1")
+}
+
+// failingLog fails to append while it is marked
+type failingLog struct {
+	ds.Log
+	failing bool
+}
+
+func (fl *failingLog) Append(data []byte) (int, error) {
+	if fl.failing {
+		return 0, errors.New("disk full")
+	}
+	return fl.Log.Append(data)
+}
+
+func TestTxManagerJournalFailure(t *testing.T) {
+	simulator := simulateTxManagerCrash(t, 5, "")
+	tm := simulator.Sys.TxManager()
+	journal := &failingLog{Log: tm.Journal()}
+	assert.Nil(t, tm.SetJournal(journal))
+
+	// the events are not acknowledged until their changes are journaled
+	journal.failing = true
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, simulator.Step())
+	}
+	status, _ := tm.Status("tx-1")
+	assert.Equal(t, service.StateInProgress, status.State)
+
+	journal.failing = false
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, simulator.Step())
+	}
+	status, _ = tm.Status("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	assert.Empty(t, simulator.Verify())
+}
+
+func TestTxManagerCompaction(t *testing.T) {
+	simulator := simulateTxManagerCrash(t, 5, "")
+	tm := simulator.Sys.TxManager()
+	tm.SetCompaction(2)
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, simulator.Step())
+	}
+
+	// the replay after the crash starts from the last snapshot
+	journal := tm.Journal()
+	assert.Greater(t, journal.Offset(service.ServiceTxManager), 0)
+	assert.LessOrEqual(t, journal.End()-journal.Offset(service.ServiceTxManager), 3)
+	status, _ := tm.Status("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	assert.Equal(t, 3, len(tm.History("tx-1")))
+	assert.Empty(t, simulator.Verify())
+}
+
+func TestDurableTxManagerJournal(t *testing.T) {
+	dir := t.TempDir()
+	simulator := simulateTxManagerCrash(t, 30, dir)
+	assert.Empty(t, simulator.Verify())
+	assert.Nil(t, simulator.Close())
+
+	// the transactions survive the restart of the whole simulation
+	simulator = simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Requests = []simulation.Request{}
+	simConf.Rounds = 1
+	simConf.LogDir = dir
+	assert.Nil(t, simulator.Simulate(*simConf))
+	defer simulator.Close()
+	status, ok := simulator.Sys.Gateway.Query("tx-1")
+	assert.True(t, ok)
+	assert.Equal(t, service.StateComplete, status.State)
+}
+
+func simulateReplicas(t *testing.T, replicas int, crashed map[string][2]int) *simulation.RoundSimulator {
+	pattern := simulation.NewDefinedIntervalPattern()
+	for srv, interval := range crashed {
+		pattern.IntervalMap[srv] = []simulation.Interval{
+			{
+				Start:       interval[0],
+				End:         interval[1],
+				FailureType: service.FailureCrash,
+			},
+		}
+	}
+
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	simConf.Rounds = 80
+	simConf.TxManagerReplicas = replicas
+	simConf.Requests = newChargeRequests(nil)
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+	return simulator
+}
+
+func replicatedTxManager(simulator *simulation.RoundSimulator) *service.ReplicatedTxManager {
+	group, _ := simulator.Sys.GetService(service.ServiceTxManager).(*service.ReplicatedTxManager)
+	return group
+}
+
+func TestReplicatedTxManager(t *testing.T) {
+	simulator := simulateReplicas(t, 3, nil)
+
+	group := replicatedTxManager(simulator)
+	assert.NotNil(t, group)
+	leader := group.Leader()
+	assert.Equal(t, "tx_manager-0", leader.Name())
+	assert.Equal(t, 1, leader.Term())
+	// every record is replicated and committed
+	for _, node := range group.Nodes() {
+		assert.Equal(t, leader.Len(), node.Len())
+		assert.Equal(t, leader.Len(), node.Commit())
+	}
+	for _, status := range simulator.Sys.Gateway.QueryAll() {
+		assert.Equal(t, service.StateComplete, status.State)
+	}
+	assert.Empty(t, simulator.Verify())
+	assert.Equal(t, 1.0, simulator.Availability())
+}
+
+func TestReplicatedTxManagerLeaderCrash(t *testing.T) {
+	// the leader crashes right after the commits are handled
+	simulator := simulateReplicas(t, 3, map[string][2]int{"tx_manager-0": {9, 30}})
+
+	group := replicatedTxManager(simulator)
+	leader := group.Leader()
+	assert.NotEqual(t, "tx_manager-0", leader.Name())
+	assert.Greater(t, leader.Term(), 1)
+	for _, status := range simulator.Sys.Gateway.QueryAll() {
+		assert.Equal(t, service.StateComplete, status.State)
+	}
+	// the committed decisions of the crashed leader are kept by the next one
+	assert.Equal(t, 1, simulator.Recoveries())
+	assert.Empty(t, simulator.Verify())
+	// the new leader rebuilds the handled events from the log and drops their redeliveries
+	assert.Greater(t, leader.TxManager().Outbox().Len(), 0)
+	for _, node := range group.Nodes() {
+		statuses, err := node.Committed()
+		assert.Nil(t, err)
+		assert.Equal(t, leader.TxManager().Statuses(), statuses)
+	}
+
+	// a single tx manager is unavailable during the whole crash
+	single := simulateReplicas(t, 1, map[string][2]int{service.ServiceTxManager: {9, 30}})
+	assert.Greater(t, simulator.Availability(), single.Availability())
+}
+
+func TestReplicatedTxManagerSendsCommitted(t *testing.T) {
+	pattern := simulation.NewDefinedIntervalPattern()
+	for _, follower := range []string{"tx_manager-1", "tx_manager-2"} {
+		pattern.Links = append(pattern.Links, simulation.LinkInterval{
+			Link:  service.Link{From: "tx_manager-0", To: follower},
+			Start: 0,
+			End:   3,
+		})
+	}
+	simulator := simulation.NewRoundSimultor()
+	simConf := simulation.NewSimulationConfig()
+	simConf.Pattern = &pattern
+	simConf.Rounds = 4
+	simConf.TxManagerReplicas = 3
+	err := simulator.Simulate(*simConf)
+	assert.Nil(t, err)
+
+	// the leader handles the transaction but sends nothing before its records are committed
+	leader := replicatedTxManager(simulator).Leader()
+	assert.Equal(t, "tx_manager-0", leader.Name())
+	assert.Greater(t, leader.Len(), leader.Commit())
+	for _, sc := range simulator.Sys.Report().Stages() {
+		assert.False(t, strings.HasPrefix(sc.Stage, service.ServicePayment), sc.Stage)
+	}
+
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, simulator.Step())
+	}
+	status, _ := simulator.Sys.Gateway.Query("tx-1")
+	assert.Equal(t, service.StateComplete, status.State)
+	assert.Empty(t, simulator.Verify())
+}
+
+func TestReplicatedTxManagerMajorityCrash(t *testing.T) {
+	simulator := simulateReplicas(t, 3, map[string][2]int{
+		"tx_manager-0": {9, 30},
+		"tx_manager-1": {10, 40},
+	})
+
+	// no leader can be elected until a majority is back
+	assert.Less(t, simulator.Availability(), 0.8)
+	for _, status := range simulator.Sys.Gateway.QueryAll() {
+		assert.Equal(t, service.StateComplete, status.State)
+		assert.Greater(t, status.Round, 30)
+	}
+	assert.Empty(t, simulator.Verify())
+}
+
+func TestInvalidReplicas(t *testing.T) {
+	simConf := simulation.NewSimulationConfig()
+	simConf.TxManagerReplicas = 2
+	err := simulation.NewRoundSimultor().Simulate(*simConf)
+	assert.ErrorIs(t, err, service.ErrInvalidReplicas)
 }